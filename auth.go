@@ -0,0 +1,98 @@
+package vanilla
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// the token is expired
+	errTokenExpired = errors.New("token is expired")
+	// the token is malformed, or not signed by us
+	errTokenInvalid = errors.New("token is invalid")
+	// the token is revoked by logout
+	errTokenRevoked = errors.New("token is revoked")
+)
+
+// tokens issues and parses the jwt tokens
+type tokens struct {
+	key []byte
+	// lifetime of the login tokens
+	expire time.Duration
+
+	// the ids of the revoked tokens, until they expire
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func newTokens(key []byte, expire time.Duration) *tokens {
+	return &tokens{key: key, expire: expire, revoked: make(map[string]time.Time)}
+}
+
+// issue a token of the username, which expires after the lifetime
+func (t *tokens) issue(username string, lifetime time.Duration) (string, error) {
+	now := time.Now()
+	claims := &jwt.StandardClaims{
+		Id:        newID(),
+		Subject:   username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+	}
+
+	// create jwt token
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(t.key)
+}
+
+// parse the token, and return the claims of it, the username is the subject
+func (t *tokens) parse(tokenStr string) (*jwt.StandardClaims, error) {
+	claims := &jwt.StandardClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		// Don't forget to validate the alg is what you expect:
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return t.key, nil
+	})
+
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, errTokenExpired
+		}
+		return nil, errTokenInvalid
+	}
+	if !token.Valid || len(claims.Subject) == 0 {
+		return nil, errTokenInvalid
+	}
+	if t.isRevoked(claims.Id) {
+		return nil, errTokenRevoked
+	}
+	return claims, nil
+}
+
+// revoke the token of the id, which expires at exp
+func (t *tokens) revoke(id string, exp time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// forget the expired ones, they can't be parsed anyway
+	now := time.Now()
+	for id, exp := range t.revoked {
+		if now.After(exp) {
+			delete(t.revoked, id)
+		}
+	}
+	t.revoked[id] = exp
+}
+
+func (t *tokens) isRevoked(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.revoked[id]
+	return ok
+}
@@ -0,0 +1,143 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+var (
+	// the scheme of the broker url is not supported
+	errUnknownBroker = errors.New("unknown broker, only redis:// is supported")
+)
+
+// broker carries the messages between the nodes of the cluster, and tracks which nodes hold the sockets of the users
+type broker interface {
+	// publish the payload to the subscribers of the subject, on every node
+	Publish(ctx context.Context, subject string, payload []byte) error
+	// subscribe the fn to the subject, it's called in the order of the messages and must not block
+	Subscribe(ctx context.Context, subject string, fn func(payload []byte)) error
+	// the node holds the sockets of the user, who has the status there, until the ttl unless joined again
+	Join(ctx context.Context, username, node, status string, ttl time.Duration) error
+	// the node holds no more sockets of the user
+	Leave(ctx context.Context, username, node string) error
+	// the nodes holding the sockets of the user, and the status of the user on each
+	Nodes(ctx context.Context, username string) (map[string]string, error)
+	// release the connections
+	Close() error
+}
+
+// the broker of the url: in-process if empty, or redis://
+func newBroker(url string) (broker, error) {
+	if len(url) == 0 {
+		return newMemoryBroker(), nil
+	}
+	if isRedisURL(url) {
+		return newRedisBroker(url)
+	}
+	return nil, errUnknownBroker
+}
+
+func validateBrokerURL(url string) error {
+	if len(url) == 0 {
+		return nil
+	}
+	if isRedisURL(url) {
+		_, err := redis.ParseURL(url)
+		return err
+	}
+	return errUnknownBroker
+}
+
+func isRedisURL(url string) bool {
+	return strings.HasPrefix(url, "redis://") || strings.HasPrefix(url, "rediss://")
+}
+
+// memoryBroker of a single node, the subscribers are called in the publishing goroutine
+type memoryBroker struct {
+	mu   sync.Mutex
+	subs map[string][]func([]byte)
+	// the nodes of the users
+	presence map[string]map[string]memoryPresence
+}
+
+// the status of a user on a node, and when it expires
+type memoryPresence struct {
+	status  string
+	expires time.Time
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{
+		subs:     make(map[string][]func([]byte)),
+		presence: make(map[string]map[string]memoryPresence),
+	}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, subject string, payload []byte) error {
+	b.mu.Lock()
+	subs := b.subs[subject]
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(payload)
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(ctx context.Context, subject string, fn func([]byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a new slice, the publishers may be calling the old one
+	b.subs[subject] = append(append([]func([]byte){}, b.subs[subject]...), fn)
+	return nil
+}
+
+func (b *memoryBroker) Join(ctx context.Context, username, node, status string, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	nodes, ok := b.presence[username]
+	if !ok {
+		nodes = make(map[string]memoryPresence)
+		b.presence[username] = nodes
+	}
+	nodes[node] = memoryPresence{status: status, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (b *memoryBroker) Leave(ctx context.Context, username, node string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.presence[username], node)
+	if len(b.presence[username]) == 0 {
+		delete(b.presence, username)
+	}
+	return nil
+}
+
+func (b *memoryBroker) Nodes(ctx context.Context, username string) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	nodes := make(map[string]string)
+	for node, p := range b.presence[username] {
+		if now.After(p.expires) {
+			delete(b.presence[username], node)
+			continue
+		}
+		nodes[node] = p.status
+	}
+	return nodes, nil
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
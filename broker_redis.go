@@ -0,0 +1,116 @@
+package vanilla
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// the prefix of the redis channels and keys
+	redisPrefix = "vanilla:"
+)
+
+// redisBroker of a cluster sharing a redis server, the presence of a user is a hash of the nodes,
+// to the status and when it expires, like online:1577836800000
+type redisBroker struct {
+	client *redis.Client
+	ps     *redis.PubSub
+
+	mu   sync.Mutex
+	subs map[string][]func([]byte)
+	once sync.Once
+}
+
+// newRedisBroker of the url, like redis://:password@localhost:6379/0, nothing is connected until used
+func newRedisBroker(url string) (*redisBroker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	return &redisBroker{
+		client: client,
+		ps:     client.Subscribe(),
+		subs:   make(map[string][]func([]byte)),
+	}, nil
+}
+
+func (b *redisBroker) Publish(ctx context.Context, subject string, payload []byte) error {
+	return b.client.WithContext(ctx).Publish(redisPrefix+subject, payload).Err()
+}
+
+func (b *redisBroker) Subscribe(ctx context.Context, subject string, fn func([]byte)) error {
+	b.mu.Lock()
+	// a new slice, the reader may be calling the old one
+	b.subs[redisPrefix+subject] = append(append([]func([]byte){}, b.subs[redisPrefix+subject]...), fn)
+	b.mu.Unlock()
+
+	if err := b.ps.Subscribe(redisPrefix + subject); err != nil {
+		return err
+	}
+	// the messages of every subject come in one channel, resubscribed after reconnecting
+	b.once.Do(func() {
+		go func() {
+			for m := range b.ps.Channel() {
+				b.mu.Lock()
+				subs := b.subs[m.Channel]
+				b.mu.Unlock()
+				for _, fn := range subs {
+					fn([]byte(m.Payload))
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+func (b *redisBroker) Join(ctx context.Context, username, node, status string, ttl time.Duration) error {
+	key := redisPrefix + "presence:" + username
+	_, err := b.client.WithContext(ctx).TxPipelined(func(p redis.Pipeliner) error {
+		p.HSet(key, node, status+":"+strconv.FormatInt(unixMilli(time.Now().Add(ttl)), 10))
+		// gone with the last node
+		p.PExpire(key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (b *redisBroker) Leave(ctx context.Context, username, node string) error {
+	return b.client.WithContext(ctx).HDel(redisPrefix+"presence:"+username, node).Err()
+}
+
+func (b *redisBroker) Nodes(ctx context.Context, username string) (map[string]string, error) {
+	all, err := b.client.WithContext(ctx).HGetAll(redisPrefix + "presence:" + username).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := unixMilli(time.Now())
+	nodes := make(map[string]string, len(all))
+	for node, v := range all {
+		i := strings.LastIndexByte(v, ':')
+		if i < 0 {
+			continue
+		}
+		// the expired ones of the dead nodes stay until the key expires
+		if exp, err := strconv.ParseInt(v[i+1:], 10, 64); err != nil || exp < now {
+			continue
+		}
+		nodes[node] = v[:i]
+	}
+	return nodes, nil
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (b *redisBroker) Close() error {
+	b.ps.Close()
+	return b.client.Close()
+}
@@ -0,0 +1,177 @@
+package vanilla
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+func TestBrokers(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	rb, err := newRedisBroker("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for name, b := range map[string]broker{"memory": newMemoryBroker(), "redis": rb} {
+		received := make(chan string, 1)
+		assert.NoError(t, b.Subscribe(ctx, "greetings", func(payload []byte) {
+			received <- string(payload)
+		}), name)
+		// let the subscription land
+		time.Sleep(time.Millisecond * 50)
+
+		assert.NoError(t, b.Publish(ctx, "greetings", []byte("hello")), name)
+		select {
+		case p := <-received:
+			assert.Equal(t, "hello", p, name)
+		case <-time.After(time.Second):
+			t.Error(name, "not received")
+		}
+
+		assert.NoError(t, b.Join(ctx, "aspirin2d", "a", statusAway, time.Minute), name)
+		assert.NoError(t, b.Join(ctx, "aspirin2d", "b", statusOnline, time.Millisecond*50), name)
+		nodes, err := b.Nodes(ctx, "aspirin2d")
+		assert.NoError(t, err, name)
+		assert.Equal(t, map[string]string{"a": statusAway, "b": statusOnline}, nodes, name)
+
+		// b expires, a leaves
+		time.Sleep(time.Millisecond * 100)
+		nodes, _ = b.Nodes(ctx, "aspirin2d")
+		assert.Equal(t, map[string]string{"a": statusAway}, nodes, name)
+		assert.NoError(t, b.Leave(ctx, "aspirin2d", "a"), name)
+		nodes, _ = b.Nodes(ctx, "aspirin2d")
+		assert.Empty(t, nodes, name)
+
+		assert.NoError(t, b.Close(), name)
+	}
+
+	cfg := DefaultConfig()
+	cfg.BrokerURL = "nats://localhost:4222"
+	_, err = New(cfg)
+	assert.Equal(t, errUnknownBroker, err)
+}
+
+func TestCluster(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	// two nodes sharing the broker
+	cfg := DefaultConfig()
+	cfg.BrokerURL = "redis://" + mr.Addr()
+	a := newTestServer(t, cfg)
+	defer a.Shutdown(context.Background())
+	b := newTestServer(t, cfg)
+	defer b.Shutdown(context.Background())
+
+	token, err := getToken(a.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialWS(websocket.DefaultDialer, "ws://"+a.Addr()+"/ws", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sd := readConnected(t, conn, jsonCodec{})
+
+	// online everywhere
+	ctx := context.Background()
+	list, err := b.hub.presence(ctx, []string{"aspirin2d"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, statusOnline, list[0].Status)
+
+	// reaches the node holding the socket
+	assert.NoError(t, b.hub.sendTo(ctx, "aspirin2d", "note", map[string]int{"n": 1}))
+	var env envelope
+	assert.NoError(t, conn.ReadJSON(&env))
+	assert.Equal(t, "note", env.Type)
+	assert.Equal(t, map[string]interface{}{"n": float64(1)}, env.Data)
+
+	assert.NoError(t, b.hub.broadcast(ctx, "news", nil))
+	assert.NoError(t, conn.ReadJSON(&env))
+	assert.Equal(t, "news", env.Type)
+
+	// the changes on any node reach the nodes holding the player's connections
+	_, err = b.st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: 1}, cause{Reason: "test"})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.ReadJSON(&env))
+	assert.Equal(t, "player.patch", env.Type)
+
+	// offline everywhere, but the messages still reach the session to resume
+	conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	list, _ = b.hub.presence(ctx, []string{"aspirin2d"}, nil)
+	assert.Equal(t, statusOffline, list[0].Status)
+	assert.NoError(t, b.hub.sendTo(ctx, "aspirin2d", "note", map[string]int{"n": 2}))
+
+	conn, _, err = dialWS(websocket.DefaultDialer, fmt.Sprintf("ws://%s/ws?session=%s&seq=4", a.Addr(), sd.ID), token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.True(t, readSession(t, conn, jsonCodec{}).Resumed)
+	assert.NoError(t, conn.ReadJSON(&env))
+	assert.Equal(t, "note", env.Type)
+	assert.Equal(t, map[string]interface{}{"n": float64(2)}, env.Data)
+}
+
+func TestClusterRevoke(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	cfg := DefaultConfig()
+	cfg.BrokerURL = "redis://" + mr.Addr()
+	a := newTestServer(t, cfg)
+	defer a.Shutdown(context.Background())
+	b := newTestServer(t, cfg)
+	defer b.Shutdown(context.Background())
+
+	token, err := getToken(a.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialWS(websocket.DefaultDialer, "ws://"+a.Addr()+"/ws", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readConnected(t, conn, jsonCodec{})
+
+	// logged out on the other node
+	req, _ := http.NewRequest("POST", "/api/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	b.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeTokenRevoked))
+
+	req, _ = http.NewRequest("GET", "/api/ping", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,663 @@
+package vanilla
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+const (
+	// the channels: global, region:<name>, guild:<id>, and private:<a>:<b> of two users sorted
+	chatGlobal  = "global"
+	chatRegion  = "region:"
+	chatGuild   = "guild:"
+	chatPrivate = "private:"
+
+	// the lists of the users
+	chatListMuted   = "muted"
+	chatListBlocked = "blocked"
+
+	// the subject of the channel messages and deletions, to the joined connections on every node
+	subjectChat = "chat"
+	// the subject of the changed lists, to the connections of the user on every node
+	subjectChatLists = "chat.lists"
+
+	// the channels one connection can join, at most
+	maxChatChannels = 50
+	// the rate limits kept before the full ones are swept
+	maxChatBuckets = 10000
+)
+
+var (
+	// the channel doesn't exist, or the user can't access it
+	errChatChannel = errors.New("no such channel")
+	// sending to a channel before joining it
+	errChatNotJoined = errors.New("channel not joined")
+	// joined too many channels
+	errChatChannels = errors.New("too many channels joined")
+	// over the rate limit
+	errChatRate = errors.New("sending too fast")
+	// the text is empty or over the max length
+	errChatLength = errors.New("message is empty or too long")
+	// the recipient doesn't exist, or it's the sender
+	errChatUser = errors.New("no such user")
+	// the recipient blocked the sender
+	errChatBlocked = errors.New("blocked by the user")
+	// deleting without being a moderator
+	errChatModerator = errors.New("not a moderator")
+	// the message to delete doesn't exist
+	errChatMessage = errors.New("no such message")
+)
+
+// ChatFilter rewrites the text of a message before it's sent, like masking the profanity,
+// or rejects the message with an error, which is sent back to the sender
+type ChatFilter func(text string) (string, error)
+
+// ChatConfig of the chat channels
+type ChatConfig struct {
+	// the names of the region channels, like region:eu
+	Regions []string
+	// the users who can delete any message
+	Moderators []string
+	// the messages a user can send per second, and in a burst, on each node
+	Rate  float64
+	Burst int
+	// the characters of a message, at most
+	MaxLength int
+	// applied to every message, none if nil
+	Filter ChatFilter
+}
+
+// DefaultChatConfig allows a message a second, five in a burst
+func DefaultChatConfig() ChatConfig {
+	return ChatConfig{
+		Rate:      1,
+		Burst:     5,
+		MaxLength: 256,
+	}
+}
+
+func (cfg *ChatConfig) validate() error {
+	if cfg.Rate <= 0 || cfg.Burst <= 0 {
+		return errors.New("chat rate and burst must be positive")
+	}
+	if cfg.MaxLength <= 0 {
+		return errors.New("chat max length must be positive")
+	}
+	for _, r := range cfg.Regions {
+		if len(r) == 0 || strings.Contains(r, ":") {
+			return errors.New("illigal chat region: " + r)
+		}
+	}
+	return nil
+}
+
+// NewWordFilter masks the whole words with asterisks, case-insensitively
+func NewWordFilter(words ...string) ChatFilter {
+	banned := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		banned[strings.ToLower(w)] = struct{}{}
+	}
+
+	return func(text string) (string, error) {
+		runes := []rune(text)
+		start := -1
+		for i := 0; i <= len(runes); i++ {
+			if i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				if start < 0 {
+					start = i
+				}
+				continue
+			}
+			if start >= 0 {
+				if _, ok := banned[strings.ToLower(string(runes[start:i]))]; ok {
+					for j := start; j < i; j++ {
+						runes[j] = '*'
+					}
+				}
+				start = -1
+			}
+		}
+		return string(runes), nil
+	}
+}
+
+// the private channel of the two users
+func privateChannel(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return chatPrivate + a + ":" + b
+}
+
+// chat of the players, the channel messages go through the broker to the joined connections on every node,
+// the private ones to every connection of both users, all of them are saved to the history
+type chat struct {
+	cfg     ChatConfig
+	hub     *hub
+	store   chatStore
+	players playerStore
+
+	regions    map[string]struct{}
+	moderators map[string]struct{}
+
+	// the rate limits of the users
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket of the messages a user can send, refilled at the rate up to the burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// the data of the chat.join and chat.leave messages
+type chatJoinData struct {
+	Channel string `json:"channel"`
+}
+
+// the data of the chat.send message, to the channel, or to the user privately
+type chatSendData struct {
+	Channel string `json:"channel,omitempty"`
+	To      string `json:"to,omitempty"`
+	Text    string `json:"text"`
+}
+
+// the data of the chat.delete message, and the chat.deleted pushed to the channel
+type chatDeleteData struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel,omitempty"`
+}
+
+// the data of the chat.mute, chat.unmute, chat.block and chat.unblock messages
+type chatUserData struct {
+	Username string `json:"username"`
+}
+
+// the event published on the chat subject, one of them is set
+type chatEvent struct {
+	Message *core.ChatMessage `json:"message,omitempty"`
+	Deleted *chatDeleteData   `json:"deleted,omitempty"`
+}
+
+// the event published on the chat.lists subject
+type chatListsEvent struct {
+	Username string          `json:"username"`
+	Lists    *core.ChatLists `json:"lists"`
+}
+
+// newChat handles the chat messages of the hub, call it before serving
+func newChat(cfg ChatConfig, h *hub, store chatStore, players playerStore) *chat {
+	ch := &chat{
+		cfg:        cfg,
+		hub:        h,
+		store:      store,
+		players:    players,
+		regions:    make(map[string]struct{}),
+		moderators: make(map[string]struct{}),
+		buckets:    make(map[string]*bucket),
+	}
+	for _, r := range cfg.Regions {
+		ch.regions[r] = struct{}{}
+	}
+	for _, m := range cfg.Moderators {
+		ch.moderators[m] = struct{}{}
+	}
+
+	h.handle("chat.join", ch.handleJoin)
+	h.handle("chat.leave", ch.handleLeave)
+	h.handle("chat.send", ch.handleSend)
+	h.handle("chat.delete", ch.handleDelete)
+	h.handle("chat.mute", ch.handleList(chatListMuted, true))
+	h.handle("chat.unmute", ch.handleList(chatListMuted, false))
+	h.handle("chat.block", ch.handleList(chatListBlocked, true))
+	h.handle("chat.unblock", ch.handleList(chatListBlocked, false))
+	return ch
+}
+
+// start receiving the chat events of the cluster
+func (ch *chat) start(ctx context.Context) error {
+	if err := ch.hub.broker.Subscribe(ctx, subjectChat, ch.receive); err != nil {
+		return err
+	}
+	return ch.hub.broker.Subscribe(ctx, subjectChatLists, ch.receiveLists)
+}
+
+// access checks whether the user can join, send to, and read the channel,
+// the private channels are not checked here
+func (ch *chat) access(ctx context.Context, username, channel string) error {
+	switch {
+	case channel == chatGlobal:
+		return nil
+	case strings.HasPrefix(channel, chatRegion):
+		if _, ok := ch.regions[strings.TrimPrefix(channel, chatRegion)]; ok {
+			return nil
+		}
+	case strings.HasPrefix(channel, chatGuild):
+		id := strings.TrimPrefix(channel, chatGuild)
+		if len(id) == 0 {
+			return errChatChannel
+		}
+		player, err := ch.players.Find(ctx, username)
+		if err != nil {
+			return err
+		}
+		if player.Guild == id {
+			return nil
+		}
+	}
+	return errChatChannel
+}
+
+// allow takes a token from the bucket of the user, if there's any
+func (ch *chat) allow(username string) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	now := time.Now()
+	burst := float64(ch.cfg.Burst)
+	if len(ch.buckets) > maxChatBuckets {
+		// the full ones are the same as the new ones
+		for u, b := range ch.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*ch.cfg.Rate >= burst {
+				delete(ch.buckets, u)
+			}
+		}
+	}
+
+	b, ok := ch.buckets[username]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		ch.buckets[username] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * ch.cfg.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// send the message of the user, after the rate limit, the length check and the filter
+func (ch *chat) send(ctx context.Context, c *client, data *chatSendData) (*core.ChatMessage, error) {
+	if !ch.allow(c.username) {
+		return nil, errChatRate
+	}
+	text := strings.TrimSpace(data.Text)
+	if len(text) == 0 || utf8.RuneCountInString(text) > ch.cfg.MaxLength {
+		return nil, errChatLength
+	}
+	if ch.cfg.Filter != nil {
+		var err error
+		if text, err = ch.cfg.Filter(text); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &core.ChatMessage{
+		ID:   primitive.NewObjectID(),
+		From: c.username,
+		Text: text,
+		Time: time.Now().UTC().Truncate(time.Millisecond),
+	}
+
+	if len(data.To) > 0 {
+		return m, ch.sendPrivate(ctx, m, data.To)
+	}
+
+	if !c.joined(data.Channel) {
+		return nil, errChatNotJoined
+	}
+	m.Channel = data.Channel
+	if err := ch.store.Save(ctx, m); err != nil {
+		return nil, err
+	}
+	return m, ch.publish(ctx, &chatEvent{Message: m})
+}
+
+// sendPrivate saves the message to the private channel, and pushes it to both users,
+// the recipient who muted the sender doesn't get it, the one who blocked the sender rejects it
+func (ch *chat) sendPrivate(ctx context.Context, m *core.ChatMessage, to string) error {
+	if to == m.From {
+		return errChatUser
+	}
+	if _, err := ch.players.Find(ctx, to); err != nil {
+		if err == errNotFound {
+			return errChatUser
+		}
+		return err
+	}
+	lists, err := ch.store.Lists(ctx, to)
+	if err != nil {
+		return err
+	}
+	if lists.Blocks(m.From) {
+		return errChatBlocked
+	}
+
+	m.Channel, m.To = privateChannel(m.From, to), to
+	if err := ch.store.Save(ctx, m); err != nil {
+		return err
+	}
+	if err := ch.hub.sendTo(ctx, m.From, "chat", m); err != nil {
+		return err
+	}
+	if lists.Hides(m.From) {
+		return nil
+	}
+	return ch.hub.sendTo(ctx, to, "chat", m)
+}
+
+// delete the message by the moderator, and tell the users who got it
+func (ch *chat) delete(ctx context.Context, moderator, id string) error {
+	if _, ok := ch.moderators[moderator]; !ok {
+		return errChatModerator
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return errChatMessage
+	}
+	m, err := ch.store.Delete(ctx, oid, moderator)
+	if err == errNotFound {
+		return errChatMessage
+	}
+	if err != nil {
+		return err
+	}
+
+	deleted := &chatDeleteData{ID: id, Channel: m.Channel}
+	if len(m.To) == 0 {
+		return ch.publish(ctx, &chatEvent{Deleted: deleted})
+	}
+	if err := ch.hub.sendTo(ctx, m.From, "chat.deleted", deleted); err != nil {
+		return err
+	}
+	return ch.hub.sendTo(ctx, m.To, "chat.deleted", deleted)
+}
+
+// setListed adds the target to the list of the user, or removes it, and updates the connections of the user
+func (ch *chat) setListed(ctx context.Context, username, list, target string, listed bool) error {
+	if len(target) == 0 || target == username {
+		return errChatUser
+	}
+	lists, err := ch.store.SetListed(ctx, username, list, target, listed)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&chatListsEvent{Username: username, Lists: lists})
+	if err != nil {
+		return err
+	}
+	return ch.hub.broker.Publish(ctx, subjectChatLists, payload)
+}
+
+func (ch *chat) publish(ctx context.Context, e *chatEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ch.hub.broker.Publish(ctx, subjectChat, payload)
+}
+
+// receive the chat event, and push it to the local connections which joined the channel
+func (ch *chat) receive(payload []byte) {
+	var e chatEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		ch.hub.metrics.brokerErrors.WithLabelValues("receive").Inc()
+		return
+	}
+	for _, c := range ch.hub.local("") {
+		switch {
+		case e.Message != nil && c.hears(e.Message.Channel, e.Message.From):
+			c.push("chat", e.Message)
+		case e.Deleted != nil && c.joined(e.Deleted.Channel):
+			c.push("chat.deleted", e.Deleted)
+		}
+	}
+}
+
+// receiveLists updates the lists of the local connections of the user, and pushes them
+func (ch *chat) receiveLists(payload []byte) {
+	var e chatListsEvent
+	if err := json.Unmarshal(payload, &e); err != nil || e.Lists == nil {
+		ch.hub.metrics.brokerErrors.WithLabelValues("receive").Inc()
+		return
+	}
+	for _, c := range ch.hub.local(e.Username) {
+		c.mu.Lock()
+		c.chatLists = e.Lists
+		c.mu.Unlock()
+		c.push("chat.lists", e.Lists)
+	}
+}
+
+// the lists of the user, which hide the messages from the muted and the blocked users
+func (ch *chat) lists(ctx context.Context, c *client) (*core.ChatLists, error) {
+	c.mu.Lock()
+	lists := c.chatLists
+	c.mu.Unlock()
+	if lists != nil {
+		return lists, nil
+	}
+
+	lists, err := ch.store.Lists(ctx, c.username)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	// a newer one may be received meanwhile
+	if c.chatLists == nil {
+		c.chatLists = lists
+	}
+	lists = c.chatLists
+	c.mu.Unlock()
+	return lists, nil
+}
+
+// handleJoin joins the channel on this connection, and replies chat.joined with the lists of the user
+func (ch *chat) handleJoin(ctx context.Context, c *client, m *message) error {
+	var data chatJoinData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+	if err := ch.access(ctx, c.username, data.Channel); err != nil {
+		return err
+	}
+	lists, err := ch.lists(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.channels == nil {
+		c.channels = make(map[string]struct{})
+	}
+	if _, ok := c.channels[data.Channel]; !ok && len(c.channels) >= maxChatChannels {
+		c.mu.Unlock()
+		return errChatChannels
+	}
+	c.channels[data.Channel] = struct{}{}
+	c.mu.Unlock()
+
+	c.push("chat.joined", &data)
+	c.push("chat.lists", lists)
+	return nil
+}
+
+// handleLeave leaves the channel on this connection
+func (ch *chat) handleLeave(ctx context.Context, c *client, m *message) error {
+	var data chatJoinData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.channels, data.Channel)
+	return nil
+}
+
+// handleSend sends the message to the joined channel, or to the user privately
+func (ch *chat) handleSend(ctx context.Context, c *client, m *message) error {
+	var data chatSendData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+	_, err := ch.send(ctx, c, &data)
+	return err
+}
+
+// handleDelete deletes the message, for the moderators
+func (ch *chat) handleDelete(ctx context.Context, c *client, m *message) error {
+	var data chatDeleteData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+	return ch.delete(ctx, c.username, data.ID)
+}
+
+// handleList adds the user to the list, or removes it
+func (ch *chat) handleList(list string, listed bool) wsHandler {
+	return func(ctx context.Context, c *client, m *message) error {
+		var data chatUserData
+		if err := c.codec.unmarshal(m.Data, &data); err != nil {
+			return errMalformedMessage
+		}
+		return ch.setListed(ctx, c.username, list, data.Username, listed)
+	}
+}
+
+// whether the connection joined the channel
+func (c *client) joined(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.channels[channel]
+	return ok
+}
+
+// whether the message of the channel from the user is pushed to the connection
+func (c *client) hears(channel, from string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.channels[channel]; !ok {
+		return false
+	}
+	return c.chatLists == nil || !c.chatLists.Hides(from)
+}
+
+// get the history of the channel, newest first, like ?before=<id>&limit=50,
+// the private channel with another user is private:<username>
+func getChatHistoryHandler(ch *chat) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetString("username")
+		channel := c.Param("channel")
+
+		var before primitive.ObjectID
+		var limit int64
+		var err error
+		if s := c.Query("before"); len(s) > 0 {
+			if before, err = primitive.ObjectIDFromHex(s); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal before",
+				})
+				return
+			}
+		}
+		if s := c.Query("limit"); len(s) > 0 {
+			if limit, err = strconv.ParseInt(s, 10, 64); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal limit",
+				})
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		if strings.HasPrefix(channel, chatPrivate) {
+			other := strings.TrimPrefix(channel, chatPrivate)
+			if len(other) == 0 || other == username || strings.Contains(other, ":") {
+				err = errChatChannel
+			}
+			channel = privateChannel(username, other)
+		} else {
+			err = ch.access(ctx, username, channel)
+		}
+		if err == errChatChannel {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"reason": "channel forbidden",
+			})
+			return
+		}
+		if err != nil {
+			abortWithPlayerError(c, err)
+			return
+		}
+
+		lists, err := ch.store.Lists(ctx, username)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to get the chat lists")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		messages, err := ch.store.History(ctx, channel, before, limit)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to get the chat history")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		visible := make([]*core.ChatMessage, 0, len(messages))
+		for _, m := range messages {
+			if !lists.Hides(m.From) {
+				visible = append(visible, m)
+			}
+		}
+		c.JSON(http.StatusOK, visible)
+	}
+}
+
+// delete the message, for the moderators
+func getChatDeleteHandler(ch *chat) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		err := ch.delete(ctx, c.GetString("username"), c.Param("id"))
+		switch err {
+		case nil:
+			c.Status(http.StatusNoContent)
+		case errChatModerator:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"reason": "not a moderator",
+			})
+		case errChatMessage:
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"reason": "message not found",
+			})
+		default:
+			requestLog(c).WithError(err).Error("failed to delete the chat message")
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+}
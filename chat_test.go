@@ -0,0 +1,175 @@
+package vanilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+// read the next message, which must be of the type
+func readType(t *testing.T, conn *websocket.Conn, typ string) map[string]interface{} {
+	var env envelope
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, typ, env.Type)
+	data, _ := env.Data.(map[string]interface{})
+	return data
+}
+
+func TestWordFilter(t *testing.T) {
+	f := NewWordFilter("darn", "heck")
+	text, err := f("Darn it, what the HECK, darnit")
+	assert.NoError(t, err)
+	assert.Equal(t, "**** it, what the ****, darnit", text)
+}
+
+func TestChat(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Chat.Regions = []string{"eu"}
+	cfg.Chat.Moderators = []string{"aspirin2d"}
+	cfg.Chat.Burst = 10
+	cfg.Chat.Filter = NewWordFilter("darn")
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+
+	rb, _ := json.Marshal(map[string]string{
+		"username": "ibuprofen",
+		"email":    "ibuprofen@example.com",
+		"password": "Passw0rd!",
+	})
+	req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(rb))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	url := "ws://" + s.Addr() + "/ws"
+	tokenA, _ := s.tokens.issue("aspirin2d", time.Minute)
+	a, _, err := dialWS(websocket.DefaultDialer, url, tokenA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	readConnected(t, a, jsonCodec{})
+	tokenB, _ := s.tokens.issue("ibuprofen", time.Minute)
+	b, _, err := dialWS(websocket.DefaultDialer, url, tokenB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	readConnected(t, b, jsonCodec{})
+
+	// no such region, nor guild
+	a.WriteJSON(gin.H{"type": "chat.join", "data": chatJoinData{Channel: "region:asia"}})
+	assert.Equal(t, errChatChannel.Error(), readType(t, a, "error")["reason"])
+	a.WriteJSON(gin.H{"type": "chat.join", "data": chatJoinData{Channel: "guild:knights"}})
+	assert.Equal(t, errChatChannel.Error(), readType(t, a, "error")["reason"])
+
+	for _, conn := range []*websocket.Conn{a, b} {
+		conn.WriteJSON(gin.H{"type": "chat.join", "data": chatJoinData{Channel: chatGlobal}})
+		assert.Equal(t, chatGlobal, readType(t, conn, "chat.joined")["channel"])
+		readType(t, conn, "chat.lists")
+	}
+	a.WriteJSON(gin.H{"type": "chat.join", "data": chatJoinData{Channel: "region:eu"}})
+	readType(t, a, "chat.joined")
+	readType(t, a, "chat.lists")
+
+	// filtered, to everyone joined
+	a.WriteJSON(gin.H{"type": "chat.send", "data": chatSendData{Channel: chatGlobal, Text: "what the darn thing"}})
+	first := readType(t, a, "chat")
+	assert.Equal(t, "what the **** thing", first["text"])
+	assert.Equal(t, first, readType(t, b, "chat"))
+
+	b.WriteJSON(gin.H{"type": "chat.send", "data": chatSendData{Channel: "region:eu", Text: "hi"}})
+	assert.Equal(t, errChatNotJoined.Error(), readType(t, b, "error")["reason"])
+
+	// muted
+	b.WriteJSON(gin.H{"type": "chat.mute", "data": chatUserData{Username: "aspirin2d"}})
+	assert.Equal(t, []interface{}{"aspirin2d"}, readType(t, b, "chat.lists")["muted"])
+	a.WriteJSON(gin.H{"type": "chat.send", "data": chatSendData{Channel: chatGlobal, Text: "hello"}})
+	hello := readType(t, a, "chat")
+	b.WriteJSON(gin.H{"type": "chat.unmute", "data": chatUserData{Username: "aspirin2d"}})
+	assert.Empty(t, readType(t, b, "chat.lists")["muted"])
+	a.WriteJSON(gin.H{"type": "chat.send", "data": chatSendData{Channel: chatGlobal, Text: "again"}})
+	readType(t, a, "chat")
+	assert.Equal(t, "again", readType(t, b, "chat")["text"])
+
+	// blocked, then private
+	b.WriteJSON(gin.H{"type": "chat.block", "data": chatUserData{Username: "aspirin2d"}})
+	readType(t, b, "chat.lists")
+	a.WriteJSON(gin.H{"type": "chat.send", "data": chatSendData{To: "ibuprofen", Text: "psst"}})
+	assert.Equal(t, errChatBlocked.Error(), readType(t, a, "error")["reason"])
+	b.WriteJSON(gin.H{"type": "chat.unblock", "data": chatUserData{Username: "aspirin2d"}})
+	readType(t, b, "chat.lists")
+	a.WriteJSON(gin.H{"type": "chat.send", "data": chatSendData{To: "ibuprofen", Text: "psst"}})
+	psst := readType(t, b, "chat")
+	assert.Equal(t, privateChannel("aspirin2d", "ibuprofen"), psst["channel"])
+	assert.Equal(t, psst, readType(t, a, "chat"))
+
+	history := func(token, path string) (int, []*core.ChatMessage) {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		var list []*core.ChatMessage
+		json.NewDecoder(w.Body).Decode(&list)
+		return w.Code, list
+	}
+
+	// newest first, page by page
+	code, list := history(tokenB, "/api/chat/global/messages?limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, "again", list[0].Text)
+		assert.Equal(t, "hello", list[1].Text)
+	}
+	_, list = history(tokenB, "/api/chat/global/messages?before="+list[1].ID.Hex())
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, first["id"], list[0].ID.Hex())
+	}
+	_, list = history(tokenB, "/api/chat/private:aspirin2d/messages")
+	assert.Len(t, list, 1)
+	code, _ = history(tokenB, "/api/chat/region:eu/messages")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = history(tokenB, "/api/chat/region:asia/messages")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = history(tokenB, "/api/chat/global/messages?before=nope")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	del := func(token, id string) int {
+		req, _ := http.NewRequest("DELETE", "/api/chat/messages/"+id, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// by the moderators only
+	assert.Equal(t, http.StatusForbidden, del(tokenB, hello["id"].(string)))
+	assert.Equal(t, http.StatusNoContent, del(tokenA, hello["id"].(string)))
+	assert.Equal(t, http.StatusNotFound, del(tokenA, "nope"))
+	deleted := chatDeleteData{ID: hello["id"].(string), Channel: chatGlobal}
+	for _, conn := range []*websocket.Conn{a, b} {
+		d := readType(t, conn, "chat.deleted")
+		assert.Equal(t, deleted.ID, d["id"])
+		assert.Equal(t, deleted.Channel, d["channel"])
+	}
+	_, list = history(tokenB, "/api/chat/global/messages")
+	assert.Len(t, list, 2)
+
+	// the burst is spent
+	for i := 0; i < 10; i++ {
+		assert.True(t, s.chat.allow("paracetamol"))
+	}
+	assert.False(t, s.chat.allow("paracetamol"))
+}
@@ -0,0 +1,158 @@
+package vanilla
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	// the subject of the messages to every user
+	subjectBroadcast = "broadcast"
+	// the subject of the messages to the users on a node, followed by the node id
+	subjectNode = "node."
+	// the subject of the revoked tokens, to every node
+	subjectRevoke = "revoke"
+)
+
+// relay is a message to the users of another node, the data is marshaled by its json tags
+// and pushed again in the codecs of the connections there
+type relay struct {
+	// the user, or everyone if empty
+	To   string          `json:"to,omitempty"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// start receiving the messages from the other nodes, and keep the presence of the local users until shutdown,
+// the last seen of the players are saved to the store
+func (h *hub) start(ctx context.Context, players playerStore) error {
+	h.players = players
+	if err := h.broker.Subscribe(ctx, subjectNode+h.node, h.receive); err != nil {
+		return err
+	}
+	if err := h.broker.Subscribe(ctx, subjectBroadcast, h.receive); err != nil {
+		return err
+	}
+	if err := h.broker.Subscribe(ctx, subjectPresence, h.receivePresence); err != nil {
+		return err
+	}
+	if err := h.broker.Subscribe(ctx, subjectRevoke, h.receiveRevoke); err != nil {
+		return err
+	}
+	go h.heartbeat()
+	return nil
+}
+
+// receive the relayed message, and deliver it to the local sessions
+func (h *hub) receive(payload []byte) {
+	var r relay
+	if err := json.Unmarshal(payload, &r); err != nil {
+		h.metrics.brokerErrors.WithLabelValues("receive").Inc()
+		return
+	}
+	var data interface{}
+	if len(r.Data) > 0 {
+		json.Unmarshal(r.Data, &data)
+	}
+	h.deliver(r.To, r.Type, data)
+}
+
+// sendTo pushes the message to every session of the user, on whichever node it is,
+// the disconnected ones get it when they're resumed
+func (h *hub) sendTo(ctx context.Context, username, typ string, data interface{}) error {
+	h.deliver(username, typ, data)
+
+	nodes, err := h.broker.Nodes(ctx, username)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	for node := range nodes {
+		if node == h.node {
+			continue
+		}
+		if payload == nil {
+			if payload, err = marshalRelay(username, typ, data); err != nil {
+				return err
+			}
+		}
+		if err := h.broker.Publish(ctx, subjectNode+node, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcast the message to every connection of the cluster, this node included once started
+func (h *hub) broadcast(ctx context.Context, typ string, data interface{}) error {
+	payload, err := marshalRelay("", typ, data)
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(ctx, subjectBroadcast, payload)
+}
+
+// revocation of a token, the data of the revoke subject
+type revocation struct {
+	ID string `json:"id"`
+	// unix seconds the token expires, it's forgotten after that
+	Expires int64 `json:"expires"`
+}
+
+// revokeToken revokes the token on every node, and closes the connections authorized with it,
+// on this node right away, even if the broker fails
+func (h *hub) revokeToken(ctx context.Context, id string, exp time.Time) error {
+	h.applyRevoke(id, exp)
+
+	payload, err := json.Marshal(&revocation{ID: id, Expires: exp.Unix()})
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(ctx, subjectRevoke, payload)
+}
+
+// receive the token revoked on another node
+func (h *hub) receiveRevoke(payload []byte) {
+	var r revocation
+	if err := json.Unmarshal(payload, &r); err != nil {
+		h.metrics.brokerErrors.WithLabelValues("receive").Inc()
+		return
+	}
+	h.applyRevoke(r.ID, time.Unix(r.Expires, 0))
+}
+
+func (h *hub) applyRevoke(id string, exp time.Time) {
+	h.tokens.revoke(id, exp)
+	h.revoke(id, closeTokenRevoked, "token revoked")
+}
+
+func marshalRelay(to, typ string, data interface{}) ([]byte, error) {
+	r := relay{To: to, Type: typ}
+	if data != nil {
+		js, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		r.Data = js
+	}
+	return json.Marshal(&r)
+}
+
+// the local clients of the user, or all of them if the username is empty
+func (h *hub) local(username string) []*client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.localLocked(username)
+}
+
+func (h *hub) localLocked(username string) []*client {
+	var clients []*client
+	for c := range h.clients {
+		if len(username) == 0 || c.username == username {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
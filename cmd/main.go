@@ -1,22 +1,234 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/sleep2death/vanilla"
+	core "github.com/sleep2death/vanilla/core"
 )
 
 func main() {
-	go func() { vanilla.Run(":8082") }()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			migrate(os.Args[2:])
+			return
+		case "ledger":
+			ledger(os.Args[2:])
+			return
+		}
+	}
+
+	cfg := vanilla.DefaultConfig()
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "listen address")
+	flag.StringVar(&cfg.MongoURI, "mongo", cfg.MongoURI, "mongodb address, a replica set or a mongos")
+	flag.StringVar(&cfg.TablesFile, "tables", cfg.TablesFile, "config tables workbook, none if empty")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert", "", "tls certificate file, serve https if set")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key", "", "tls key file")
+	flag.StringVar(&cfg.RedirectAddr, "redirect-addr", "", "listen address to redirect http to https")
+	flag.BoolVar(&cfg.DisableHTTP2, "disable-http2", false, "serve https with HTTP/1.1 only")
+	flag.DurationVar(&cfg.ShutdownDelay, "shutdown-delay", 0, "time to keep serving after turning not ready")
+	timeout := flag.Duration("shutdown-timeout", 10*time.Second, "time allowed to shutdown gracefully")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log format: text or json")
+	flag.Int64Var(&cfg.WS.ReadLimit, "ws-read-limit", cfg.WS.ReadLimit, "maximum websocket message size from the clients")
+	flag.DurationVar(&cfg.WS.PingInterval, "ws-ping-interval", cfg.WS.PingInterval, "websocket ping interval")
+	flag.DurationVar(&cfg.WS.PongTimeout, "ws-pong-timeout", cfg.WS.PongTimeout, "time allowed for the websocket clients to answer")
+	flag.DurationVar(&cfg.WS.WriteTimeout, "ws-write-timeout", cfg.WS.WriteTimeout, "time allowed to write a websocket message")
+	flag.IntVar(&cfg.WS.SendQueueSize, "ws-send-queue", cfg.WS.SendQueueSize, "outbound websocket messages pending for a client, at most")
+	overflow := flag.String("ws-overflow", string(cfg.WS.Overflow), "when the send queue is full: drop_oldest or disconnect")
+	flag.BoolVar(&cfg.WS.Compression, "ws-compression", cfg.WS.Compression, "websocket permessage-deflate")
+	flag.IntVar(&cfg.WS.ResumeBuffer, "ws-resume-buffer", cfg.WS.ResumeBuffer, "websocket messages kept for the session resumption, at most")
+	flag.DurationVar(&cfg.WS.ResumeTimeout, "ws-resume-timeout", cfg.WS.ResumeTimeout, "how long a disconnected websocket session can be resumed")
+	flag.StringVar(&cfg.BrokerURL, "broker", "", "broker between the nodes, like redis://localhost:6379/0, in-process if empty")
+	flag.DurationVar(&cfg.WS.PresenceTTL, "presence-ttl", cfg.WS.PresenceTTL, "how long the presence of a user on a node lasts without the heartbeat")
+	flag.DurationVar(&cfg.WS.AwayAfter, "away-after", cfg.WS.AwayAfter, "a websocket client without any message for this long is away")
+	chatRegions := flag.String("chat-regions", "", "comma separated names of the region chat channels")
+	chatModerators := flag.String("chat-moderators", "", "comma separated users who can delete any chat message")
+	chatWords := flag.String("chat-banned-words", "", "comma separated words masked in the chat messages")
+	flag.Float64Var(&cfg.Chat.Rate, "chat-rate", cfg.Chat.Rate, "chat messages a user can send per second")
+	flag.IntVar(&cfg.Chat.Burst, "chat-burst", cfg.Chat.Burst, "chat messages a user can send in a burst")
+	corsOrigins := flag.String("cors-origins", "", "comma separated origins allowed for the browsers, like https://*.example.com")
+	flag.BoolVar(&cfg.CORS.AllowCredentials, "cors-credentials", false, "allow the browsers to send the credentials")
+	flag.StringVar(&cfg.TraceExporter, "trace-exporter", "", "export the traces to: stdout or otlp, none if empty")
+	flag.StringVar(&cfg.TraceEndpoint, "trace-endpoint", "", "host:port of the otlp collector")
+	flag.BoolVar(&cfg.TraceInsecure, "trace-insecure", false, "export to the otlp collector over plain http")
+	flag.Parse()
+	cfg.WS.Overflow = vanilla.OverflowPolicy(*overflow)
+	if len(*chatRegions) > 0 {
+		cfg.Chat.Regions = strings.Split(*chatRegions, ",")
+	}
+	if len(*chatModerators) > 0 {
+		cfg.Chat.Moderators = strings.Split(*chatModerators, ",")
+	}
+	if len(*chatWords) > 0 {
+		cfg.Chat.Filter = vanilla.NewWordFilter(strings.Split(*chatWords, ",")...)
+	}
+	if len(*corsOrigins) > 0 {
+		cfg.CORS.AllowOrigins = strings.Split(*corsOrigins, ",")
+	}
+
+	logger, err := vanilla.NewLogger(cfg.LogLevel, cfg.LogFormat, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gin.SetMode(gin.ReleaseMode)
+
+	srv, err := vanilla.New(cfg)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		logger.Fatal(err)
+	}
+	logger.WithField("addr", srv.Addr()).Info("listening")
+
 	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	// the timeout.
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	vanilla.Stop()
+	select {
+	case <-quit:
+	case err := <-srv.Err():
+		logger.WithError(err).Error("server error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("shutdown error")
+	}
+}
+
+// migrate [-mongo addr] up [version] | down [steps] | status
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	addr := fs.String("mongo", "mongodb://localhost:27017", "mongodb address")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: migrate [-mongo addr] up [version] | down [steps] | status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	switch fs.Arg(0) {
+	case "up", "down", "status":
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// the optional version or steps argument
+	n := 0
+	if fs.NArg() > 1 {
+		var err error
+		if n, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			fs.Usage()
+			os.Exit(2)
+		}
+	}
+
+	m, err := vanilla.OpenMigrator(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer m.Close(ctx)
+
+	switch fs.Arg(0) {
+	case "up":
+		err = m.Up(ctx, n)
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		err = m.Down(ctx, n)
+	case "status":
+		var status []vanilla.MigrationStatus
+		if status, err = m.Status(ctx); err == nil {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tAPPLIED\tDESCRIPTION")
+			for _, s := range status {
+				applied := "pending"
+				if !s.Applied.IsZero() {
+					applied = s.Applied.Format("2006-01-02 15:04:05")
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, applied, s.Description)
+			}
+			w.Flush()
+		}
+	}
+
+	if err != nil {
+		m.Close(ctx)
+		log.Fatal(err)
+	}
+}
+
+// ledger [-mongo addr] [-fix] username
+func ledger(args []string) {
+	fs := flag.NewFlagSet("ledger", flag.ExitOnError)
+	addr := fs.String("mongo", "mongodb://localhost:27017", "mongodb address, a replica set or a mongos")
+	fix := fs.Bool("fix", false, "rebuild the stored balances from the ledger")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ledger [-mongo addr] [-fix] username")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	l, err := vanilla.OpenLedger(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer l.Close(ctx)
+
+	report, err := l.Replay(ctx, fs.Arg(0), *fix)
+	if err != nil {
+		l.Close(ctx)
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTIME\tREASON\tSOURCE\tGOLD\tFOOD\tWOOD\tSTONE\tIRON\tCRYSTAL")
+	for _, e := range report.Entries {
+		d := e.Delta
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", e.Version, e.Time.Format("2006-01-02 15:04:05"),
+			e.Reason, e.Source, d.Gold, d.Food, d.Wood, d.Stone, d.Iron, d.Crystal)
+	}
+	for _, row := range []struct {
+		name string
+		r    core.Resources
+	}{{"ledger", report.Ledger}, {"stored", report.Stored}} {
+		r := row.r
+		fmt.Fprintf(w, "\t\t%s\t\t%d\t%d\t%d\t%d\t%d\t%d\n", row.name, r.Gold, r.Food, r.Wood, r.Stone, r.Iron, r.Crystal)
+	}
+	w.Flush()
+
+	switch {
+	case report.Matched():
+		fmt.Println("balances match the ledger")
+	case *fix:
+		fmt.Println("balances rebuilt from the ledger")
+	default:
+		fmt.Println("balances DON'T match the ledger, run with -fix to rebuild them")
+	}
 }
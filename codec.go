@@ -0,0 +1,216 @@
+package vanilla
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v4"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	// the frame is not a message of the codec
+	errMalformedMessage = errors.New("malformed message")
+
+	// the codecs by the subprotocol, in the order of preference
+	codecs = []codec{msgpackCodec{}, protoCodec{}, jsonCodec{}}
+)
+
+// the outbound envelope of json and msgpack
+type envelope struct {
+	Seq  uint64      `json:"seq,omitempty"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// message from the peer, the data is left encoded until the handler of the type unmarshals it
+type message struct {
+	Type string
+	Data []byte
+}
+
+// codec of the websocket messages, negotiated by the subprotocol at upgrade,
+// every message is one frame of the envelope {seq, type, data}, the seq is omitted from the peer,
+// the payloads are marshaled by their json tags in every codec
+type codec interface {
+	// the subprotocol
+	name() string
+	// websocket.TextMessage or websocket.BinaryMessage
+	frameType() int
+	// encode the message of the seq and type, the seq is 0 if not sequenced, the data may be nil
+	encode(seq uint64, typ string, data interface{}) ([]byte, error)
+	// decode the frame, without the data
+	decode(frame []byte) (*message, error)
+	// unmarshal the data of a decoded message
+	unmarshal(data []byte, v interface{}) error
+}
+
+// the codec of the subprotocol, json if none is selected
+func codecOf(subprotocol string) codec {
+	for _, c := range codecs {
+		if c.name() == subprotocol {
+			return c
+		}
+	}
+	return jsonCodec{}
+}
+
+// the subprotocols of the codecs, in the order of preference
+func codecProtocols() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.name()
+	}
+	return names
+}
+
+// jsonCodec in text frames: {"seq": 1, "type": "...", "data": {...}}
+type jsonCodec struct{}
+
+func (jsonCodec) name() string   { return wsProtocol }
+func (jsonCodec) frameType() int { return websocket.TextMessage }
+
+func (jsonCodec) encode(seq uint64, typ string, data interface{}) ([]byte, error) {
+	return json.Marshal(envelope{seq, typ, data})
+}
+
+func (jsonCodec) decode(frame []byte) (*message, error) {
+	var env struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(frame, &env); err != nil || len(env.Type) == 0 {
+		return nil, errMalformedMessage
+	}
+	return &message{Type: env.Type, Data: env.Data}, nil
+}
+
+func (jsonCodec) unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errMalformedMessage
+	}
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec in binary frames, the same map as json
+type msgpackCodec struct{}
+
+func (msgpackCodec) name() string   { return wsProtocol + ".msgpack" }
+func (msgpackCodec) frameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) encode(seq uint64, typ string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := msgpack.NewEncoder(&buf).UseJSONTag(true).Encode(envelope{seq, typ, data})
+	return buf.Bytes(), err
+}
+
+// msgpack has no raw message, so the data is the whole frame, unmarshaled again
+func (msgpackCodec) decode(frame []byte) (*message, error) {
+	var env struct {
+		Type string `json:"type"`
+	}
+	if err := msgpack.NewDecoder(bytes.NewReader(frame)).UseJSONTag(true).Decode(&env); err != nil || len(env.Type) == 0 {
+		return nil, errMalformedMessage
+	}
+	return &message{Type: env.Type, Data: frame}, nil
+}
+
+func (msgpackCodec) unmarshal(data []byte, v interface{}) error {
+	env := struct {
+		Data interface{} `json:"data"`
+	}{Data: v}
+	return msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(&env)
+}
+
+// protoCodec in binary frames: message Envelope { string type = 1; google.protobuf.Value data = 2; uint64 seq = 3; },
+// the numbers of the data are doubles
+type protoCodec struct{}
+
+func (protoCodec) name() string   { return wsProtocol + ".proto" }
+func (protoCodec) frameType() int { return websocket.BinaryMessage }
+
+func (protoCodec) encode(seq uint64, typ string, data interface{}) ([]byte, error) {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, typ)
+	if seq > 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, seq)
+	}
+	if data == nil {
+		return b, nil
+	}
+
+	// to the plain values by the json tags first
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var plain interface{}
+	if err := json.Unmarshal(js, &plain); err != nil {
+		return nil, err
+	}
+	value, err := structpb.NewValue(plain)
+	if err != nil {
+		return nil, err
+	}
+	vb, err := proto.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, vb), nil
+}
+
+func (protoCodec) decode(frame []byte) (*message, error) {
+	m := &message{}
+	for len(frame) > 0 {
+		num, typ, n := protowire.ConsumeTag(frame)
+		if n < 0 {
+			return nil, errMalformedMessage
+		}
+		frame = frame[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(frame)
+			if n < 0 {
+				return nil, errMalformedMessage
+			}
+			m.Type, frame = s, frame[n:]
+		case num == 2 && typ == protowire.BytesType:
+			b, n := protowire.ConsumeBytes(frame)
+			if n < 0 {
+				return nil, errMalformedMessage
+			}
+			m.Data, frame = b, frame[n:]
+		default:
+			// skip the unknown fields
+			n := protowire.ConsumeFieldValue(num, typ, frame)
+			if n < 0 {
+				return nil, errMalformedMessage
+			}
+			frame = frame[n:]
+		}
+	}
+	if len(m.Type) == 0 {
+		return nil, errMalformedMessage
+	}
+	return m, nil
+}
+
+func (protoCodec) unmarshal(data []byte, v interface{}) error {
+	var value structpb.Value
+	if err := proto.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	js, err := json.Marshal(value.AsInterface())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
@@ -0,0 +1,88 @@
+package vanilla
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	type payload struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+		Tags  []string
+	}
+	in := &payload{Name: "line\nbreak", Count: 42, Tags: []string{"a", "b"}}
+
+	for _, cd := range codecs {
+		frame, err := cd.encode(7, "test", in)
+		if !assert.NoError(t, err, cd.name()) {
+			continue
+		}
+		m, err := cd.decode(frame)
+		if !assert.NoError(t, err, cd.name()) {
+			continue
+		}
+		assert.Equal(t, "test", m.Type, cd.name())
+
+		var out payload
+		assert.NoError(t, cd.unmarshal(m.Data, &out), cd.name())
+		assert.Equal(t, *in, out, cd.name())
+
+		// no data
+		frame, _ = cd.encode(0, "ping", nil)
+		m, err = cd.decode(frame)
+		assert.NoError(t, err, cd.name())
+		assert.Equal(t, "ping", m.Type, cd.name())
+
+		_, err = cd.decode([]byte("\xff\x00 garbage"))
+		assert.Error(t, err, cd.name())
+	}
+
+	assert.Equal(t, "vanilla", codecOf("").name())
+	assert.Equal(t, "vanilla.proto", codecOf("vanilla.proto").name())
+}
+
+func TestWSCodecNegotiation(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cd := range codecs {
+		d := *websocket.DefaultDialer
+		d.Subprotocols = []string{cd.name(), wsBearerPrefix + token}
+		conn, resp, err := d.Dial("ws://"+s.Addr()+"/ws", nil)
+		if !assert.NoError(t, err, cd.name()) {
+			continue
+		}
+		assert.Equal(t, cd.name(), resp.Header.Get("Sec-WebSocket-Protocol"))
+		readConnected(t, conn, cd)
+
+		// one message per frame, in the frame type of the codec
+		frame, _ := cd.encode(0, "nonsense", map[string]string{"a": "b"})
+		conn.WriteMessage(cd.frameType(), frame)
+		conn.WriteMessage(cd.frameType(), frame)
+
+		for i := 0; i < 2; i++ {
+			mt, frame, err := conn.ReadMessage()
+			if !assert.NoError(t, err, cd.name()) {
+				break
+			}
+			assert.Equal(t, cd.frameType(), mt)
+
+			m, err := cd.decode(frame)
+			assert.NoError(t, err, cd.name())
+			assert.Equal(t, "error", m.Type)
+			var e wsError
+			cd.unmarshal(m.Data, &e)
+			assert.Equal(t, wsError{For: "nonsense", Reason: errUnknownMessage.Error()}, e)
+		}
+		conn.Close()
+	}
+}
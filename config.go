@@ -0,0 +1,101 @@
+package vanilla
+
+import (
+	"errors"
+	"time"
+)
+
+// Config of the server
+type Config struct {
+	// listen address, port 0 picks a free one, see Server.Addr
+	Addr string
+	// mongodb address, a replica set or a mongos, the transactions don't run on a standalone server
+	MongoURI string
+	// the config tables workbook, none if empty
+	TablesFile string
+
+	// key to sign the jwt tokens
+	JWTKey []byte
+	// lifetime of the login tokens
+	TokenExpire time.Duration
+
+	// serve https and wss with the certificate and key files, both reloaded when changed,
+	// plain http if empty
+	TLSCertFile string
+	TLSKeyFile  string
+	// listen address of the plain http server which redirects everything to https, none if empty
+	RedirectAddr string
+	// serve https with HTTP/1.1 only
+	DisableHTTP2 bool
+
+	// time to keep serving after /readyz turns unavailable at shutdown,
+	// so the load balancer can stop routing new traffic here
+	ShutdownDelay time.Duration
+
+	// log level: debug, info, warn or error
+	LogLevel string
+	// log format: text or json
+	LogFormat string
+
+	// the websocket connections
+	WS WSConfig
+	// the broker between the nodes of the cluster, like redis://localhost:6379/0,
+	// in-process for a single node if empty
+	BrokerURL string
+
+	// the chat channels
+	Chat ChatConfig
+
+	// the browser clients on the other origins, for both http and websocket
+	CORS CORSConfig
+
+	// export the traces to: stdout, otlp (over http), or nowhere if empty
+	TraceExporter string
+	// host:port of the otlp collector, localhost:4318 if empty
+	TraceEndpoint string
+	// export to the otlp collector over plain http
+	TraceInsecure bool
+}
+
+// DefaultConfig for local development
+func DefaultConfig() Config {
+	return Config{
+		Addr:        ":8082",
+		MongoURI:    "mongodb://localhost:27017",
+		JWTKey:      []byte("vanilla_icecream"),
+		TokenExpire: time.Minute * 30,
+		LogLevel:    "info",
+		LogFormat:   "text",
+		WS:          DefaultWSConfig(),
+		Chat:        DefaultChatConfig(),
+		CORS:        DefaultCORSConfig(),
+	}
+}
+
+func (cfg *Config) validate() error {
+	if len(cfg.MongoURI) == 0 {
+		return errors.New("mongodb address is empty")
+	}
+	if len(cfg.JWTKey) == 0 {
+		return errors.New("jwt key is empty")
+	}
+	if cfg.TokenExpire <= 0 {
+		return errors.New("token expire must be positive")
+	}
+	if (len(cfg.TLSCertFile) == 0) != (len(cfg.TLSKeyFile) == 0) {
+		return errors.New("tls needs both the certificate and the key file")
+	}
+	if len(cfg.RedirectAddr) > 0 && len(cfg.TLSCertFile) == 0 {
+		return errors.New("redirect to https needs tls")
+	}
+	if err := validateBrokerURL(cfg.BrokerURL); err != nil {
+		return err
+	}
+	if err := cfg.WS.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Chat.validate(); err != nil {
+		return err
+	}
+	return cfg.CORS.validate()
+}
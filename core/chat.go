@@ -0,0 +1,48 @@
+package core
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChatMessage of a channel, the id orders the messages of a channel
+type ChatMessage struct {
+	ID      primitive.ObjectID `bson:"_id" json:"id"`
+	Channel string             `bson:"channel" json:"channel"`
+	From    string             `bson:"from" json:"from"`
+	// the recipient of a private message
+	To   string    `bson:"to,omitempty" json:"to,omitempty"`
+	Text string    `bson:"text" json:"text"`
+	Time time.Time `bson:"time" json:"time"`
+	// deleted by a moderator, kept out of the history
+	Deleted   bool   `bson:"deleted,omitempty" json:"-"`
+	DeletedBy string `bson:"deletedBy,omitempty" json:"-"`
+}
+
+// ChatLists of a user: the muted users are hidden in the channels,
+// the blocked ones are hidden too, and can't send private messages to the user
+type ChatLists struct {
+	Username string   `bson:"_id" json:"-"`
+	Muted    []string `bson:"muted" json:"muted"`
+	Blocked  []string `bson:"blocked" json:"blocked"`
+}
+
+// Hides the messages from the user
+func (l *ChatLists) Hides(username string) bool {
+	return contains(l.Muted, username) || contains(l.Blocked, username)
+}
+
+// Blocks the private messages from the user
+func (l *ChatLists) Blocks(username string) bool {
+	return contains(l.Blocked, username)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
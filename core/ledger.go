@@ -0,0 +1,50 @@
+package core
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LedgerEntry records a change of the resources of a player, the ledger is append-only
+type LedgerEntry struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Username string             `bson:"username" json:"username"`
+	Delta    Resources          `bson:"delta" json:"delta"`
+	// why the resources changed, e.g. "build" or "admin_grant"
+	Reason string `bson:"reason" json:"reason"`
+	// the action which made the change, e.g. "ws:build"
+	Source string `bson:"source" json:"source"`
+	// the player version after the change, orders the entries of a player
+	Version int64     `bson:"version" json:"version"`
+	Time    time.Time `bson:"time" json:"time"`
+}
+
+// Add the other resources to r
+func (r Resources) Add(other Resources) Resources {
+	return Resources{
+		Gold:    r.Gold + other.Gold,
+		Food:    r.Food + other.Food,
+		Wood:    r.Wood + other.Wood,
+		Stone:   r.Stone + other.Stone,
+		Iron:    r.Iron + other.Iron,
+		Crystal: r.Crystal + other.Crystal,
+	}
+}
+
+// Sub the other resources from r
+func (r Resources) Sub(other Resources) Resources {
+	return Resources{
+		Gold:    r.Gold - other.Gold,
+		Food:    r.Food - other.Food,
+		Wood:    r.Wood - other.Wood,
+		Stone:   r.Stone - other.Stone,
+		Iron:    r.Iron - other.Iron,
+		Crystal: r.Crystal - other.Crystal,
+	}
+}
+
+// IsZero reports whether all the resources are zero
+func (r Resources) IsZero() bool {
+	return r == Resources{}
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Notification in the inbox of a player, newer ones have greater ids
+type Notification struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Username string             `bson:"username" json:"-"`
+	// what happened, e.g. "build" or "attack"
+	Category string `bson:"category" json:"category"`
+	Title    string `bson:"title" json:"title"`
+	Body     string `bson:"body,omitempty" json:"body,omitempty"`
+	// the details for the client, like the id of the tile attacked
+	Data map[string]string `bson:"data,omitempty" json:"data,omitempty"`
+	Read bool              `bson:"read" json:"read"`
+	Time time.Time         `bson:"time" json:"time"`
+}
+
+// NotificationPref of a category, both on unless set
+type NotificationPref struct {
+	// kept in the inbox
+	Inbox bool `bson:"inbox" json:"inbox"`
+	// pushed when the player is online
+	Push bool `bson:"push" json:"push"`
+}
+
+// NotificationPrefs of a player, by category
+type NotificationPrefs struct {
+	Username   string                      `bson:"_id" json:"-"`
+	Categories map[string]NotificationPref `bson:"categories" json:"categories"`
+}
+
+// Pref of the category
+func (p *NotificationPrefs) Pref(category string) NotificationPref {
+	if pref, ok := p.Categories[category]; ok {
+		return pref
+	}
+	return NotificationPref{Inbox: true, Push: true}
+}
@@ -9,6 +9,17 @@ type Player struct {
 	ID       primitive.ObjectID `bson:"_id"`
 	Username string             `bson:"username"`
 	Created  int64              `bson:"created"`
+	// bumped by every update, used to detect concurrent changes
+	Version int64 `bson:"version" json:"version"`
+
+	DisplayName string `bson:"displayName" json:"displayName"`
+	Avatar      string `bson:"avatar" json:"avatar"`
+	Bio         string `bson:"bio" json:"bio"`
+
+	// unix seconds the player last connected or disconnected
+	LastSeen int64 `bson:"lastSeen" json:"lastSeen"`
+	// the id of the guild the player is in, none if empty
+	Guild string `bson:"guild,omitempty" json:"guild,omitempty"`
 
 	Crystal int64
 
@@ -23,6 +34,70 @@ type Player struct {
 	Iron  int64 `bson:"iron" json:"iron"`
 }
 
+// Resources of a player, or a change of them
+type Resources struct {
+	Gold    int64 `bson:"gold" json:"gold"`
+	Food    int64 `bson:"food" json:"food"`
+	Wood    int64 `bson:"wood" json:"wood"`
+	Stone   int64 `bson:"stone" json:"stone"`
+	Iron    int64 `bson:"iron" json:"iron"`
+	Crystal int64 `bson:"crystal" json:"crystal"`
+}
+
+// Resources the player owns
+func (p *Player) Resources() Resources {
+	return Resources{
+		Gold:    p.Gold,
+		Food:    p.Food,
+		Wood:    p.Wood,
+		Stone:   p.Stone,
+		Iron:    p.Iron,
+		Crystal: p.Crystal,
+	}
+}
+
+// SetResources of the player
+func (p *Player) SetResources(r Resources) {
+	p.Gold = r.Gold
+	p.Food = r.Food
+	p.Wood = r.Wood
+	p.Stone = r.Stone
+	p.Iron = r.Iron
+	p.Crystal = r.Crystal
+}
+
+// AddResources adds the delta to the player, it returns false and changes nothing
+// if any of the resources would go below zero
+func (p *Player) AddResources(delta Resources) bool {
+	r := p.Resources().Add(delta)
+	if r.Gold < 0 || r.Food < 0 || r.Wood < 0 || r.Stone < 0 || r.Iron < 0 || r.Crystal < 0 {
+		return false
+	}
+
+	p.SetResources(r)
+	return true
+}
+
+// Profile is the public view of a player, visible to everyone
+type Profile struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Avatar      string `json:"avatar"`
+	Bio         string `json:"bio"`
+	Created     int64  `json:"created"`
+}
+
+// Profile returns the public view of the player
+func (p *Player) Profile() *Profile {
+	return &Profile{
+		Username:    p.Username,
+		DisplayName: p.DisplayName,
+		Avatar:      p.Avatar,
+		Bio:         p.Bio,
+		Created:     p.Created,
+	}
+}
+
 // Tile Data struct
 type Tile struct {
 	ID        string     `bson:"tid" json:"tid"`
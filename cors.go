@@ -0,0 +1,170 @@
+package vanilla
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig of the browser clients on the other origins
+type CORSConfig struct {
+	// the allowed origins, exact like https://game.example.com,
+	// or any subdomain like https://*.example.com, or * for any origin without credentials
+	AllowOrigins []string
+	// the methods allowed by the preflight
+	AllowMethods []string
+	// the request headers allowed by the preflight
+	AllowHeaders []string
+	// the response headers the browser may read
+	ExposeHeaders []string
+	// allow the cookies and the http authentication
+	AllowCredentials bool
+	// how long the preflight may be cached
+	MaxAge time.Duration
+}
+
+// DefaultCORSConfig allows no other origin
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Authorization", requestIDHeader, "traceparent", "tracestate"},
+		ExposeHeaders: []string{"Content-Length", requestIDHeader},
+		MaxAge:        time.Hour * 24,
+	}
+}
+
+// an allowed origin, the host is a suffix for the subdomains
+type originPattern struct {
+	scheme string
+	host   string
+	any    bool
+}
+
+// origins is the compiled allow-list
+type origins struct {
+	patterns []originPattern
+	any      bool
+}
+
+func newOrigins(allow []string) (*origins, error) {
+	o := &origins{}
+	for _, s := range allow {
+		if s == "*" {
+			o.any = true
+			continue
+		}
+
+		u, err := url.Parse(s)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 || len(u.Path) > 0 {
+			return nil, fmt.Errorf("illigal cors origin: %s", s)
+		}
+		p := originPattern{scheme: u.Scheme, host: strings.ToLower(u.Host)}
+		if strings.HasPrefix(p.host, "*.") {
+			p.host, p.any = p.host[1:], true
+		}
+		if strings.Contains(p.host, "*") {
+			return nil, fmt.Errorf("illigal cors origin: %s", s)
+		}
+		o.patterns = append(o.patterns, p)
+	}
+	return o, nil
+}
+
+// allowed reports whether the origin is in the list
+func (o *origins) allowed(origin string) bool {
+	if o.any {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	for _, p := range o.patterns {
+		if p.scheme != u.Scheme {
+			continue
+		}
+		if p.any && strings.HasSuffix(host, p.host) || !p.any && host == p.host {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin of the websocket upgrade: the clients which are not browsers send no origin,
+// the browsers must be on the same origin, or an allowed one
+func (o *origins) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return o.allowed(origin)
+}
+
+func (cfg *CORSConfig) validate() error {
+	o, err := newOrigins(cfg.AllowOrigins)
+	if err != nil {
+		return err
+	}
+	if o.any && cfg.AllowCredentials {
+		return fmt.Errorf("cors credentials can't be allowed for any origin")
+	}
+	return nil
+}
+
+// CORSMiddleware answers the preflights, and allows the origins of the config to read the responses,
+// the config must be valid
+func CORSMiddleware(cfg CORSConfig) gin.HandlerFunc {
+	o, _ := newOrigins(cfg.AllowOrigins)
+	methods := strings.Join(cfg.AllowMethods, ", ")
+	headers := strings.Join(cfg.AllowHeaders, ", ")
+	expose := strings.Join(cfg.ExposeHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge / time.Second))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if len(origin) == 0 {
+			c.Next()
+			return
+		}
+
+		preflight := c.Request.Method == http.MethodOptions && len(c.GetHeader("Access-Control-Request-Method")) > 0
+		h := c.Writer.Header()
+		h.Add("Vary", "Origin")
+		if !o.allowed(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			// the browser hides the response
+			c.Next()
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			h.Set("Access-Control-Max-Age", maxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		if len(expose) > 0 {
+			h.Set("Access-Control-Expose-Headers", expose)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,89 @@
+package vanilla
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrigins(t *testing.T) {
+	o, err := newOrigins([]string{"https://game.example.com", "https://*.example.org", "http://localhost:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, o.allowed("https://game.example.com"))
+	assert.False(t, o.allowed("http://game.example.com"))
+	assert.False(t, o.allowed("https://evil.game.example.com"))
+	assert.True(t, o.allowed("https://a.example.org"))
+	assert.True(t, o.allowed("https://a.b.example.org"))
+	assert.False(t, o.allowed("https://example.org"))
+	assert.False(t, o.allowed("https://evilexample.org"))
+	assert.True(t, o.allowed("http://localhost:8080"))
+	assert.False(t, o.allowed("http://localhost:8081"))
+
+	for _, s := range []string{"game.example.com", "https://game.example.com/", "https://a.*.example.com"} {
+		_, err := newOrigins([]string{s})
+		assert.Error(t, err, s)
+	}
+
+	cfg := DefaultCORSConfig()
+	cfg.AllowOrigins, cfg.AllowCredentials = []string{"*"}, true
+	assert.Error(t, cfg.validate())
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CORS.AllowOrigins = []string{"https://*.example.com"}
+	cfg.CORS.AllowCredentials = true
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("OPTIONS", "/api/me", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "PATCH")
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://game.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://game.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "PATCH")
+	// the notification preferences are put
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "PUT")
+	assert.NotContains(t, w.Header().Get("Access-Control-Allow-Methods"), "UPDATE")
+
+	w = preflight("https://evil.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// the websocket upgrade shares the allow-list
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		return dialWS(websocket.DefaultDialer, "ws://"+s.Addr()+"/ws", token, http.Header{"Origin": {origin}})
+	}
+
+	_, resp, err := dial("https://evil.com")
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	for _, origin := range []string{"https://game.example.com", "http://" + s.Addr()} {
+		conn, _, err := dial(origin)
+		if assert.NoError(t, err, origin) {
+			conn.Close()
+		}
+	}
+}
@@ -2,9 +2,12 @@ package vanilla
 
 import (
 	"context"
-	"log"
+	"errors"
 	"time"
 
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -15,13 +18,63 @@ const (
 	DBName string = "vanilla"
 	// UserCollection name
 	UserCollection string = "users"
+	// PlayerCollection name
+	PlayerCollection string = "players"
+	// LedgerCollection is the append-only log of the resource changes
+	LedgerCollection string = "ledger"
+	// ChatCollection keeps the chat history
+	ChatCollection string = "chat"
+	// ChatListCollection keeps the mute and block lists of the users
+	ChatListCollection string = "chat_lists"
+	// NotificationCollection keeps the inboxes of the players
+	NotificationCollection string = "notifications"
+	// NotificationPrefCollection keeps the notification preferences of the players
+	NotificationPrefCollection string = "notification_prefs"
+	// MigrationCollection records the applied migrations
+	MigrationCollection string = "migrations"
+	// MigrationLockCollection holds the lock of the running migration
+	MigrationLockCollection string = "migration_locks"
 )
 
-func initDB(addr string) (*mongo.Database, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// the mongodb is a standalone server, which can't run the transactions
+var errStandaloneMongo = errors.New("mongodb must be a replica set or a sharded cluster for the transactions, " +
+	"a single node can run as one with --replSet rs0 and rs.initiate()")
+
+func initDB(ctx context.Context, addr string, monitor *event.CommandMonitor, log logrus.FieldLogger) (*mongo.Database, error) {
+	db, err := connectDB(ctx, addr, monitor)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareDB(ctx, db, log); err != nil {
+		db.Client().Disconnect(ctx)
+		return nil, err
+	}
+	return db, nil
+}
+
+// prepareDB checks the transactions, migrates the schema to the latest version,
+// then creates the indexes
+func prepareDB(ctx context.Context, db *mongo.Database, log logrus.FieldLogger) error {
+	if err := checkTransactions(ctx, db); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, migrateTimeout)
+	defer cancel()
+	m := NewMigrator(db)
+	m.log = log
+	if err := m.Up(ctx, 0); err != nil {
+		return err
+	}
+	return ensureIndexes(ctx, db, indexes)
+}
+
+// connectDB to the mongodb of the addr, the monitor is optional
+func connectDB(ctx context.Context, addr string, monitor *event.CommandMonitor) (*mongo.Database, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(addr))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(addr).SetMonitor(monitor))
 	if err != nil {
 		return nil, err
 	}
@@ -29,9 +82,45 @@ func initDB(addr string) (*mongo.Database, error) {
 	// test piing
 	err = client.Ping(ctx, readpref.Primary())
 	if err != nil {
+		client.Disconnect(ctx)
 		return nil, err
 	}
 
-	log.Println("connected to mongodb")
 	return client.Database(DBName), nil
 }
+
+// checkTransactions fails unless the mongodb is a replica set member or a mongos,
+// registering and the resource changes run in transactions
+func checkTransactions(ctx context.Context, db *mongo.Database) error {
+	var hello bson.M
+	if err := db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		return err
+	}
+	return transactionsSupported(hello)
+}
+
+// transactionsSupported by the server of the isMaster reply
+func transactionsSupported(hello bson.M) error {
+	if _, ok := hello["setName"]; ok {
+		return nil
+	}
+	if msg, _ := hello["msg"].(string); msg == "isdbgrid" {
+		return nil
+	}
+	return errStandaloneMongo
+}
+
+// isDuplicateKey reports whether the err is caused by a unique index
+func isDuplicateKey(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == 11000 {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == 11000
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package vanilla
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// connect to the mongodb of VANILLA_TEST_MONGO, a replica set, or skip the test,
+// every test gets its own database, dropped when it's done
+func testMongo(t *testing.T) *mongo.Database {
+	addr := os.Getenv("VANILLA_TEST_MONGO")
+	if len(addr) == 0 {
+		t.Skip("VANILLA_TEST_MONGO not set")
+	}
+
+	ctx := context.Background()
+	db, err := connectDB(ctx, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTransactions(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	db = db.Client().Database(fmt.Sprintf("vanilla_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(ctx)
+		db.Client().Disconnect(ctx)
+	})
+	return db
+}
+
+func TestTransactionsSupported(t *testing.T) {
+	assert.NoError(t, transactionsSupported(bson.M{"ismaster": true, "setName": "rs0"}))
+	assert.NoError(t, transactionsSupported(bson.M{"ismaster": true, "msg": "isdbgrid"}))
+	assert.Equal(t, errStandaloneMongo, transactionsSupported(bson.M{"ismaster": true}))
+}
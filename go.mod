@@ -4,20 +4,27 @@ go 1.12
 
 require (
 	github.com/DataDog/zstd v1.4.4 // indirect
+	github.com/alicebob/miniredis/v2 v2.11.4
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/dlclark/regexp2 v1.2.0
 	github.com/gin-gonic/gin v1.5.0
 	github.com/go-ozzo/ozzo-validation/v3 v3.8.1
-	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/go-redis/redis/v7 v7.4.0
 	github.com/golang/snappy v0.0.1 // indirect
-	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/gorilla/websocket v1.4.1
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/stretchr/testify v1.4.0
+	github.com/prometheus/client_golang v1.3.0
+	github.com/sirupsen/logrus v1.4.2
+	github.com/stretchr/testify v1.7.0
 	github.com/tidwall/pretty v1.0.0 // indirect
+	github.com/vmihailenco/msgpack/v4 v4.3.12
 	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
 	github.com/xdg/stringprep v1.0.0 // indirect
 	go.mongodb.org/mongo-driver v1.2.0
-	golang.org/x/crypto v0.0.0-20191219195013-becbf705a915
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	google.golang.org/protobuf v1.27.1
 )
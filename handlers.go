@@ -2,9 +2,8 @@ package vanilla
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,17 +11,13 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	core "github.com/sleep2death/vanilla/core"
 )
 
-var jwtKey = []byte("vanilla_icecream")
-var expire = time.Minute * 30
-
 // login form binding
 type login struct {
 	Username string `form:"username" json:"username" bson:"username"  binding:"required"`
@@ -36,7 +31,7 @@ type register struct {
 	Password string `form:"password" json:"password" bson:"password" binding:"required"`
 }
 
-func getLoginHandler(db *mongo.Database) gin.HandlerFunc {
+func getLoginHandler(users userStore, tokens *tokens, m *metrics) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var json login
 		if err := c.ShouldBindJSON(&json); err != nil {
@@ -52,15 +47,12 @@ func getLoginHandler(db *mongo.Database) gin.HandlerFunc {
 			return
 		}
 
-		opts := options.FindOne()
-		filter := bson.M{"username": json.Username}
-
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
 		defer cancel()
-		res := db.Collection(UserCollection).FindOne(ctx, filter, opts)
+		r, err := users.Find(ctx, json.Username)
 
-		if err := res.Err(); err != nil {
-			if err.Error() == "mongo: no documents in result" {
+		if err != nil {
+			if err == errNotFound {
 				c.JSON(http.StatusUnauthorized, gin.H{
 					"reason": "username not existed",
 				})
@@ -69,11 +61,9 @@ func getLoginHandler(db *mongo.Database) gin.HandlerFunc {
 			}
 			return
 		}
-		r := &login{}
-		if err := res.Decode(r); err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-		}
+		start := time.Now()
 		cErr := bcrypt.CompareHashAndPassword([]byte(r.Password), []byte(json.Password))
+		m.bcrypt("compare", start)
 		if cErr != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"reason": "password not match",
@@ -81,14 +71,7 @@ func getLoginHandler(db *mongo.Database) gin.HandlerFunc {
 			return
 		}
 
-		claims := &jwt.StandardClaims{
-			Id:        r.Username,
-			ExpiresAt: time.Now().Add(expire).Unix(),
-		}
-
-		// create jwt token
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenStr, err := token.SignedString(jwtKey)
+		tokenStr, err := tokens.issue(r.Username, tokens.expire)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"reason": "failed to generate token",
@@ -96,9 +79,6 @@ func getLoginHandler(db *mongo.Database) gin.HandlerFunc {
 			return
 		}
 
-		// log.Println("token:", tokenStr)
-		// c.Header("Authorization", "Bearer "+tokenString)
-
 		c.JSON(http.StatusOK, gin.H{
 			"status": "ok",
 			"token":  tokenStr,
@@ -106,7 +86,7 @@ func getLoginHandler(db *mongo.Database) gin.HandlerFunc {
 	}
 }
 
-func getRegisterHandler(db *mongo.Database) gin.HandlerFunc {
+func getRegisterHandler(users userStore, tokens *tokens, m *metrics) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var json register
 		if err := c.ShouldBindJSON(&json); err != nil {
@@ -116,7 +96,7 @@ func getRegisterHandler(db *mongo.Database) gin.HandlerFunc {
 
 		// valid username and password pattern first
 		if err := json.Validate(); err != nil {
-			log.Println(err)
+			requestLog(c).WithError(err).Debug("illigal register")
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"reason": "illigal username or password",
 			})
@@ -124,57 +104,55 @@ func getRegisterHandler(db *mongo.Database) gin.HandlerFunc {
 		}
 
 		// encrypt the password
+		start := time.Now()
 		hash, err := bcrypt.GenerateFromPassword([]byte(json.Password), bcrypt.DefaultCost)
+		m.bcrypt("hash", start)
 		if err != nil {
-			log.Println(err)
+			requestLog(c).WithError(err).Error("failed to hash the password")
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"reason": "password encryption error",
 			})
 			return
 		}
 
-		// log.Printf("User register: %s %s %s", json.Username, json.Email, hash)
-		opts := options.FindOneAndUpdate().SetUpsert(true)
-		filter := bson.M{"username": json.Username}
-		update := bson.M{"$setOnInsert": bson.M{"username": json.Username, "email": json.Email, "password": string(hash)}}
+		acc := &account{
+			ID:       primitive.NewObjectID(),
+			Username: json.Username,
+			Email:    json.Email,
+			Password: string(hash),
+		}
+		player := &core.Player{
+			ID:       primitive.NewObjectID(),
+			Username: json.Username,
+			Created:  time.Now().Unix(),
+		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
 		defer cancel()
 
-		res := db.Collection(UserCollection).FindOneAndUpdate(ctx, filter, update, opts)
-
-		if err := res.Err(); err != nil {
-			if err.Error() == "mongo: no documents in result" {
-				claims := &jwt.StandardClaims{
-					Id:        json.Username,
-					ExpiresAt: time.Now().Add(time.Second * 60).Unix(),
-				}
-
-				// create jwt token
-				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-				tokenStr, err := token.SignedString(jwtKey)
-				if err != nil {
-					c.JSON(http.StatusUnauthorized, gin.H{
-						"reason": "failed to generate token",
-					})
-					return
-				}
-
-				// log.Println("token:", tokenStr)
-				// c.Header("Authorization", "Bearer "+tokenString)
-
-				c.JSON(http.StatusOK, gin.H{
-					"status": "ok",
-					"token":  tokenStr,
+		if err := users.Create(ctx, acc, player); err != nil {
+			if err == errUsernameTaken || err == errEmailTaken {
+				c.JSON(http.StatusConflict, gin.H{
+					"reason": err.Error(),
 				})
 				return
 			}
+			requestLog(c).WithError(err).Error("failed to create the account")
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		c.JSON(http.StatusBadRequest, gin.H{
-			"reason": "username existed",
+		tokenStr, err := tokens.issue(json.Username, time.Second*60)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"reason": "failed to generate token",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+			"token":  tokenStr,
 		})
 	}
 }
@@ -185,7 +163,7 @@ func getPingHandler() gin.HandlerFunc {
 	}
 }
 
-func authMiddleware() gin.HandlerFunc {
+func authMiddleware(tokens *tokens) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth := c.GetHeader("Authorization")
 		if len(auth) == 0 {
@@ -204,110 +182,170 @@ func authMiddleware() gin.HandlerFunc {
 		}
 
 		tokenStr := authHeaderParts[1]
-		// log.Println("token", tokenStr)
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-			// Don't forget to validate the alg is what you expect:
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return jwtKey, nil
-		})
-
+		claims, err := tokens.parse(tokenStr)
 		if err != nil {
-			if err.Error() == "Token is expired" {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"reason": "token is expired",
-				})
-			} else {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"reason": "token is invalid",
-				})
-			}
-			return
-		}
-
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			log.Println(claims["jti"], claims["exp"])
-			c.Set("username", claims["jti"])
-			c.Next()
-		} else {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"reason": "token is invalid",
+				"reason": err.Error(),
 			})
 			return
 		}
+
+		c.Set("username", claims.Subject)
+		c.Set("claims", claims)
+		c.Set(logKey, requestLog(c).WithField("username", claims.Subject))
+		c.Next()
 	}
 }
 
-func getPlayerInfoHandler(db *mongo.Database) gin.HandlerFunc {
+// revoke the token of the caller, and close its websocket connections, on every node
+func getLogoutHandler(h *hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		username := c.DefaultQuery("username", "")
-		if len(username) == 0 {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"reason": "username is empty",
+		claims := c.MustGet("claims").(*jwt.StandardClaims)
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		if err := h.revokeToken(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+			// revoked here only, the client can logout again
+			requestLog(c).WithError(err).Error("failed to publish the revocation")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"reason": "failed to revoke the token",
 			})
 			return
 		}
 
-		opts := options.FindOne()
-		filter := bson.M{"username": username}
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// deprecated marks the route replaced by the successor, and logs every use of it,
+// so the old clients can be found before the route is removed
+func deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+successor+">; rel=\"successor-version\"")
+		requestLog(c).WithFields(logrus.Fields{
+			"path":      c.Request.URL.Path,
+			"successor": successor,
+		}).Warn("deprecated route used")
+		c.Next()
+	}
+}
+
+// profile form binding, nil fields are left untouched
+type profile struct {
+	DisplayName *string `form:"displayName" json:"displayName"`
+	Avatar      *string `form:"avatar" json:"avatar"`
+	Bio         *string `form:"bio" json:"bio"`
+}
+
+// get the full player state of the caller
+func getMeHandler(players playerStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
 		defer cancel()
 
-		res := db.Collection(UserCollection).FindOne(ctx, filter, opts)
+		player, err := players.Find(ctx, c.GetString("username"))
+		if err != nil {
+			abortWithPlayerError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, player)
+	}
+}
 
-		if res.Err() != nil {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-				"reason": "user not found",
-			})
+// update the display name, avatar or bio of the caller
+func getUpdateMeHandler(players playerStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var json profile
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		player := &core.Player{}
-		if err := res.Decode(player); err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"reason": "user data invalid",
+		if err := json.Validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"reason": "illigal profile",
 			})
 			return
 		}
 
-		if player.Created == 0 {
-			player.Created = time.Now().Unix()
-
-			filter = bson.M{"username": player.Username}
-			ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
-			defer cancel()
-			res = db.Collection(UserCollection).FindOneAndUpdate(ctx, filter, bson.M{"$set": player})
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
 
-			if res.Err() != nil {
-				log.Println(res.Err())
-				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-					"reason": "failed to create user",
-				})
-				return
-			}
+		player, err := players.UpdateProfile(ctx, c.GetString("username"), &json)
+		if err != nil {
+			abortWithPlayerError(c, err)
+			return
 		}
 
 		c.JSON(http.StatusOK, player)
 	}
+}
+
+// get the public profile of any player
+func getPlayerHandler(players playerStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		player, err := players.Find(ctx, c.Param("name"))
+		if err != nil {
+			abortWithPlayerError(c, err)
+			return
+		}
 
+		c.JSON(http.StatusOK, player.Profile())
+	}
 }
 
-// CORSMiddleware allow all
-func CORSMiddleware() gin.HandlerFunc {
+// get the resource ledger of the caller, newest first
+func getLedgerHandler(ledger ledgerStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Max-Age", "86400")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, UPDATE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-
-		if c.Request.Method == "OPTIONS" {
-			fmt.Println("OPTIONS")
-			c.AbortWithStatus(200)
-		} else {
-			c.Next()
+		q := ledgerQuery{Reason: c.Query("reason")}
+		var err error
+		if before := c.Query("before"); len(before) > 0 {
+			if q.Before, err = strconv.ParseInt(before, 10, 64); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal before",
+				})
+				return
+			}
+		}
+		if limit := c.Query("limit"); len(limit) > 0 {
+			if q.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal limit",
+				})
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		entries, err := ledger.List(ctx, c.GetString("username"), q)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to list the ledger")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
 		}
+
+		c.JSON(http.StatusOK, entries)
+	}
+}
+
+func abortWithPlayerError(c *gin.Context, err error) {
+	if err == errNotFound {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"reason": "user not found",
+		})
+		return
 	}
+
+	requestLog(c).WithError(err).Error("failed to access the player")
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+		"reason": "user data invalid",
+	})
 }
@@ -2,6 +2,7 @@ package vanilla
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +18,39 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// start a server on a free port, with the in-memory storage and a registered test user
+func newTestServer(t *testing.T, cfg Config) *Server {
+	cfg.Addr = "127.0.0.1:0"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.st = newMemoryStorage()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rb, _ := json.Marshal(map[string]string{
+		"username": "aspirin2d",
+		"email":    "aspirin2d@example.com",
+		"password": "Passw0rd!",
+	})
+	req, _ := http.NewRequest("POST", "register", bytes.NewBuffer(rb))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal("failed to register")
+	}
+	return s
+}
+
+// dial the websocket with the token in the subprotocols
+func dialWS(d *websocket.Dialer, url, token string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	dd := *d
+	dd.Subprotocols = []string{wsProtocol, wsBearerPrefix + token}
+	return dd.Dial(url, header)
+}
+
 func getToken(r *gin.Engine) (string, error) {
 
 	// login and get the token
@@ -43,13 +77,14 @@ func getToken(r *gin.Engine) (string, error) {
 }
 
 func TestLoginHandler(t *testing.T) {
-	r, err := setupRouter()
-	if err != nil {
-		t.Error(err)
-	}
+	// set expire time to 3s
+	cfg := DefaultConfig()
+	cfg.TokenExpire = time.Second * 3
+	expire := cfg.TokenExpire
 
-	// set expire time to 5s
-	expire = time.Second * 3
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+	r := s.router
 
 	// get api/ping with fail if not login
 	w := httptest.NewRecorder()
@@ -102,21 +137,19 @@ func TestLoginHandler(t *testing.T) {
 	assert.Equal(t, "token is expired", resp["reason"])
 }
 
-func TestPlayerInfoHandler(t *testing.T) {
-	r, err := setupRouter()
-	if err != nil {
-		t.Error(err)
-	}
+func TestMeHandler(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+	r := s.router
 
 	// login and get the token
 	token, err := getToken(r)
 	if err != nil {
 		t.Error(err)
 	}
-	// t.Logf("response token is %s", resp["token"])
 
-	// get api/ping with the token
-	req, _ := http.NewRequest("GET", "api/playerinfo?username=aspirin2d", nil)
+	// get api/me with the token
+	req, _ := http.NewRequest("GET", "api/me", nil)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
@@ -127,24 +160,105 @@ func TestPlayerInfoHandler(t *testing.T) {
 		t.Error(err)
 	}
 	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "aspirin2d", resp.Username)
+
+	// the deprecated alias
+	req, _ = http.NewRequest("GET", "api/playerinfo?username=aspirin2d", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	resp = core.Player{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	assert.Equal(t, "aspirin2d", resp.Username)
+
+	// update the profile
+	rb, _ := json.Marshal(map[string]string{
+		"displayName": "Aspirin",
+		"bio":         "hello world",
+	})
+	req, _ = http.NewRequest("PATCH", "api/me", bytes.NewBuffer(rb))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, "Aspirin", resp.DisplayName)
+	assert.Equal(t, "hello world", resp.Bio)
+
+	// illigal avatar url
+	rb, _ = json.Marshal(map[string]string{
+		"avatar": "not a url",
+	})
+	req, _ = http.NewRequest("PATCH", "api/me", bytes.NewBuffer(rb))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// empty display name
+	rb, _ = json.Marshal(map[string]string{
+		"displayName": "",
+	})
+	req, _ = http.NewRequest("PATCH", "api/me", bytes.NewBuffer(rb))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
-func TestWebsocket(t *testing.T) {
-	router, err := setupRouter()
+func TestPlayerHandler(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+	r := s.router
+
+	// login and get the token
+	token, err := getToken(r)
 	if err != nil {
-		t.Fatal(err)
+		t.Error(err)
+	}
+
+	// get the public profile with the token
+	req, _ := http.NewRequest("GET", "api/players/aspirin2d", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]interface{}
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Error(err)
 	}
+	assert.Equal(t, "aspirin2d", resp["username"])
+	// resources and ids are private
+	assert.NotContains(t, resp, "gold")
+	assert.NotContains(t, resp, "ID")
 
-	go router.Run(":8082")
-	time.Sleep(time.Second)
+	// player not existed
+	req, _ = http.NewRequest("GET", "api/players/nobody_here", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebsocket(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
 
 	// login and get the token
-	token, err := getToken(router)
+	token, err := getToken(s.router)
 	if err != nil {
 		t.Error(err)
 	}
 
-	conn, resp, err := websocket.DefaultDialer.Dial("ws://localhost:8082/ws?token="+token, nil)
+	conn, resp, err := dialWS(websocket.DefaultDialer, "ws://"+s.Addr()+"/ws", token, nil)
 	if err != nil {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
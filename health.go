@@ -0,0 +1,65 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// time allowed for all the readiness checks
+const readyTimeout = 2 * time.Second
+
+// the component is optional and not set up, which doesn't make the server unready
+var errNotConfigured = errors.New("not configured")
+
+// check tells whether a component is ready, a nil error means it is
+type check struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// the process is alive, if it can answer at all
+func getHealthHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// the server is ready only if all the components are
+func getReadyHandler(checks []check) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+		defer cancel()
+
+		// run the checks in parallel, so a slow one doesn't hide the others
+		errs := make([]error, len(checks))
+		done := make(chan int, len(checks))
+		for i := range checks {
+			go func(i int) {
+				errs[i] = checks[i].fn(ctx)
+				done <- i
+			}(i)
+		}
+		for range checks {
+			<-done
+		}
+
+		status, code := "ok", http.StatusOK
+		components := gin.H{}
+		for i, ch := range checks {
+			if errs[i] == errNotConfigured {
+				components[ch.name] = gin.H{"status": errNotConfigured.Error()}
+			} else if errs[i] != nil {
+				status, code = "unavailable", http.StatusServiceUnavailable
+				components[ch.name] = gin.H{"status": "unavailable", "reason": errs[i].Error()}
+			} else {
+				components[ch.name] = gin.H{"status": "ok"}
+			}
+		}
+
+		c.JSON(code, gin.H{"status": status, "components": components})
+	}
+}
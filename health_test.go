@@ -0,0 +1,67 @@
+package vanilla
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ShutdownDelay = time.Millisecond * 500
+	cfg.TablesFile = "config/config.xlsx"
+	s := newTestServer(t, cfg)
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	ready := func() (int, map[string]interface{}) {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+
+		var resp map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, resp
+	}
+
+	code, resp := ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", resp["status"])
+	components := resp["components"].(map[string]interface{})
+	for _, name := range []string{"mongo", "tables", "hub", "server"} {
+		assert.Equal(t, "ok", components[name].(map[string]interface{})["status"])
+	}
+
+	// not ready while shutting down
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown(context.Background())
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	code, resp = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	components = resp["components"].(map[string]interface{})
+	assert.Equal(t, "unavailable", components["server"].(map[string]interface{})["status"])
+	assert.Equal(t, "ok", components["mongo"].(map[string]interface{})["status"])
+	<-done
+
+	// no tables configured, still ready
+	s = newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+	code, resp = ready()
+	assert.Equal(t, http.StatusOK, code)
+	components = resp["components"].(map[string]interface{})
+	assert.Equal(t, "not configured", components["tables"].(map[string]interface{})["status"])
+}
@@ -0,0 +1,222 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// the hub is shutting down, no more clients or actions
+	errHubClosing = errors.New("hub is closing")
+)
+
+// hub keeps track of the websocket clients, which http.Server doesn't know after hijacking
+type hub struct {
+	cfg WSConfig
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	closing bool
+	// the sessions by id, attached or waiting to be resumed
+	sessions map[string]*session
+	// the same sessions by username, the messages to a user go to all of them
+	userSessions map[string]map[*session]struct{}
+
+	// in-flight game actions
+	actions sync.WaitGroup
+
+	metrics *metrics
+	tracer  trace.Tracer
+	// to renew the tokens of the clients
+	tokens *tokens
+
+	// the handlers of the message types, registered before serving
+	handlers map[string]wsHandler
+	// called for every client after its session is attached, and after it's gone, registered before serving
+	connectHooks    []func(c *client)
+	disconnectHooks []func(c *client)
+
+	// the other nodes of the cluster are reached through the broker
+	broker broker
+	// the id of this node
+	node string
+	// closed to stop the heartbeat
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// the status of the local users last joined, and the users being refreshed, true if asked again,
+	// the presenceMu is never held across the broker or the store
+	presenceMu sync.Mutex
+	statuses   map[string]string
+	refreshing map[string]bool
+	// signaled when a refresh worker is done
+	refreshed chan struct{}
+	// the last seen of the players are saved here once started
+	players playerStore
+}
+
+// wsHandler handles a message of the client, the error is sent back to it
+type wsHandler func(ctx context.Context, c *client, m *message) error
+
+func newHub(cfg WSConfig, m *metrics, tracer trace.Tracer, tokens *tokens, b broker) *hub {
+	h := &hub{
+		cfg:          cfg,
+		clients:      make(map[*client]struct{}),
+		sessions:     make(map[string]*session),
+		userSessions: make(map[string]map[*session]struct{}),
+		metrics:      m,
+		tracer:       tracer,
+		tokens:       tokens,
+		handlers:     make(map[string]wsHandler),
+		broker:       b,
+		node:         newID(),
+		stop:         make(chan struct{}),
+		statuses:     make(map[string]string),
+		refreshing:   make(map[string]bool),
+		refreshed:    make(chan struct{}, 1),
+	}
+	h.handle("auth", handleAuth)
+	h.handle("ack", handleAck)
+	h.handle("presence.status", handlePresenceStatus)
+	h.handle("presence.watch", handlePresenceWatch)
+	h.handle("presence.unwatch", handlePresenceUnwatch)
+	return h
+}
+
+// handle the messages of the type with the fn, not safe to call while serving
+func (h *hub) handle(typ string, fn wsHandler) {
+	h.handlers[typ] = fn
+}
+
+// observe the clients connecting and disconnecting, not safe to call while serving
+func (h *hub) observe(connect, disconnect func(c *client)) {
+	h.connectHooks = append(h.connectHooks, connect)
+	h.disconnectHooks = append(h.disconnectHooks, disconnect)
+}
+
+// the client is ready to push to
+func (h *hub) connected(c *client) {
+	for _, fn := range h.connectHooks {
+		fn(c)
+	}
+}
+
+func (h *hub) handler(typ string) (wsHandler, bool) {
+	fn, ok := h.handlers[typ]
+	return fn, ok
+}
+
+// running until shutdown
+func (h *hub) running() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closing {
+		return errHubClosing
+	}
+	return nil
+}
+
+// register the client, fails if the hub is shutting down
+func (h *hub) register(c *client) error {
+	h.mu.Lock()
+	if h.closing {
+		h.mu.Unlock()
+		return errHubClosing
+	}
+	h.clients[c] = struct{}{}
+	h.metrics.wsConnections.Inc()
+	h.mu.Unlock()
+
+	h.refresh(c.username)
+	return nil
+}
+
+func (h *hub) unregister(c *client) {
+	h.mu.Lock()
+	_, ok := h.clients[c]
+	if ok {
+		delete(h.clients, c)
+		h.metrics.wsConnections.Dec()
+	}
+	h.mu.Unlock()
+
+	if ok {
+		h.refresh(c.username)
+		for _, fn := range h.disconnectHooks {
+			fn(c)
+		}
+	}
+}
+
+// revoke closes the clients authorized with the token of the id
+func (h *hub) revoke(tokenID string, code int, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if c.token() == tokenID {
+			c.close(code, reason)
+		}
+	}
+}
+
+// beginAction marks a game action in-flight, fails if the hub is shutting down,
+// every successful call must be paired with an endAction
+func (h *hub) beginAction() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closing {
+		return errHubClosing
+	}
+	h.actions.Add(1)
+	return nil
+}
+
+func (h *hub) endAction() {
+	h.actions.Done()
+}
+
+// shutdown refuses new clients and actions, then closes every client with a close frame
+// after its pending messages are sent, and waits for the clients and the in-flight actions to finish,
+// the clients still open when the ctx is done are closed right away
+func (h *hub) shutdown(ctx context.Context, code int, reason string) error {
+	h.mu.Lock()
+	h.closing = true
+	h.stopOnce.Do(func() { close(h.stop) })
+	clients := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		c.close(code, reason)
+	}
+
+	// wait for all the clients, then all the actions
+	done := make(chan struct{})
+	go func() {
+		for _, c := range clients {
+			<-c.done
+		}
+		h.actions.Wait()
+		// the watchers are told the users are gone
+		h.waitRefreshes()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, c := range clients {
+			c.ws.Close()
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,73 @@
+package vanilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHubShutdown(t *testing.T) {
+	tokens := newTokens([]byte("vanilla_icecream"), time.Minute)
+	h := newHub(DefaultWSConfig(), newMetrics(), trace.NewNoopTracerProvider().Tracer(""), tokens, newMemoryBroker())
+	router := gin.New()
+	router.GET("/ws", getWSHandler(h, tokens, newTickets(), &origins{}))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	token, _ := tokens.issue("aspirin2d", tokens.expire)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	conn, _, err := dialWS(websocket.DefaultDialer, url, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// wait for the client to register, then queue a message for it
+	var c *client
+	for c == nil {
+		h.mu.Lock()
+		for k := range h.clients {
+			c = k
+		}
+		h.mu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+	}
+	c.enqueue("", []byte("build completed"))
+
+	// answer the close frame like a browser does
+	done := make(chan error)
+	go func() {
+		// the session message comes first
+		conn.ReadMessage()
+		_, msg, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "build completed", string(msg))
+
+		_, _, err = conn.ReadMessage()
+		done <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	assert.Nil(t, h.shutdown(ctx, websocket.CloseServiceRestart, "server restarting"))
+
+	err = <-done
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseServiceRestart))
+	assert.Equal(t, "server restarting", err.(*websocket.CloseError).Text)
+
+	// no more clients
+	conn, _, err = dialWS(websocket.DefaultDialer, url, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseServiceRestart))
+}
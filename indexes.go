@@ -0,0 +1,91 @@
+package vanilla
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// unique index names, used to tell which field is duplicated
+	usernameIndex = "username_unique"
+	emailIndex    = "email_unique"
+)
+
+// indexSpec declares an index of a collection
+type indexSpec struct {
+	Collection string
+	Name       string
+	// index keys in order, more than one key makes a compound index
+	Keys   bson.D
+	Unique bool
+	// documents expire TTL after the time in the (only) indexed field, zero means never
+	TTL time.Duration
+}
+
+// all the indexes, created by initDB at startup
+var indexes = []indexSpec{
+	{Collection: UserCollection, Name: usernameIndex, Keys: bson.D{{Key: "username", Value: 1}}, Unique: true},
+	{Collection: UserCollection, Name: emailIndex, Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+	{Collection: PlayerCollection, Name: usernameIndex, Keys: bson.D{{Key: "username", Value: 1}}, Unique: true},
+	{Collection: LedgerCollection, Name: "username_version", Keys: bson.D{{Key: "username", Value: 1}, {Key: "version", Value: -1}}},
+	{Collection: ChatCollection, Name: "channel_id", Keys: bson.D{{Key: "channel", Value: 1}, {Key: "_id", Value: -1}}},
+	{Collection: NotificationCollection, Name: "username_id", Keys: bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: -1}}},
+}
+
+func (spec *indexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(spec.Name)
+	if spec.Unique {
+		opts.SetUnique(true)
+	}
+	if spec.TTL > 0 {
+		opts.SetExpireAfterSeconds(int32(spec.TTL / time.Second))
+	}
+	return mongo.IndexModel{Keys: spec.Keys, Options: opts}
+}
+
+// create the missing indexes, an existing index with the same name but different options is an error
+func ensureIndexes(ctx context.Context, db *mongo.Database, specs []indexSpec) error {
+	models := make(map[string][]mongo.IndexModel)
+	// keep the collections in declaration order
+	var cols []string
+	for i := range specs {
+		col := specs[i].Collection
+		if _, ok := models[col]; !ok {
+			cols = append(cols, col)
+		}
+		models[col] = append(models[col], specs[i].model())
+	}
+
+	for _, col := range cols {
+		if _, err := db.Collection(col).Indexes().CreateMany(ctx, models[col]); err != nil {
+			return fmt.Errorf("failed to create indexes of %s: %v", col, err)
+		}
+	}
+	return nil
+}
+
+// duplicateKeyIndex returns the name of the unique index which the err violated,
+// empty if it's not a duplicate key error
+func duplicateKeyIndex(err error) string {
+	if !isDuplicateKey(err) {
+		return ""
+	}
+
+	// E11000 duplicate key error collection: vanilla.users index: email_unique dup key: { ... }
+	msg := err.Error()
+	i := strings.Index(msg, "index: ")
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(msg[i+len("index: "):])
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
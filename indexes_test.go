@@ -0,0 +1,27 @@
+package vanilla
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDuplicateKeyIndex(t *testing.T) {
+	err := mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+		Code:    11000,
+		Message: `E11000 duplicate key error collection: vanilla.users index: email_unique dup key: { : "a@b.com" }`,
+	}}}
+	assert.Equal(t, emailIndex, duplicateKeyIndex(err))
+
+	cmdErr := mongo.CommandError{
+		Code:    11000,
+		Message: `E11000 duplicate key error collection: vanilla.users index: username_unique dup key: { : "aspirin2d" }`,
+	}
+	assert.Equal(t, usernameIndex, duplicateKeyIndex(cmdErr))
+
+	// not a duplicate key error
+	assert.Equal(t, "", duplicateKeyIndex(mongo.CommandError{Code: 112, Message: "WriteConflict"}))
+	assert.Equal(t, "", duplicateKeyIndex(errors.New("index: email_unique")))
+}
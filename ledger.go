@@ -0,0 +1,81 @@
+package vanilla
+
+import (
+	"context"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+// LedgerReport compares the balances rebuilt from the ledger with the stored ones
+type LedgerReport struct {
+	Username string
+	// all the ledger entries of the player, oldest first
+	Entries []*core.LedgerEntry
+	// the balances the ledger adds up to
+	Ledger core.Resources
+	// the balances stored on the player
+	Stored core.Resources
+}
+
+// Matched reports whether the stored balances agree with the ledger
+func (r *LedgerReport) Matched() bool {
+	return r.Ledger == r.Stored
+}
+
+// Ledger replays the resource ledger of the players
+type Ledger struct {
+	st storage
+}
+
+// OpenLedger connects to the mongodb at addr, without migrating anything
+func OpenLedger(addr string) (*Ledger, error) {
+	ctx := context.Background()
+	db, err := connectDB(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the replay reads and fixes in a transaction
+	if err := checkTransactions(ctx, db); err != nil {
+		db.Client().Disconnect(ctx)
+		return nil, err
+	}
+	return &Ledger{st: newMongoStorage(db)}, nil
+}
+
+// Close the mongodb connection
+func (l *Ledger) Close(ctx context.Context) error {
+	return l.st.Close(ctx)
+}
+
+// Replay the ledger of the player, and rebuild the stored balances from it if fix is set
+func (l *Ledger) Replay(ctx context.Context, username string, fix bool) (*LedgerReport, error) {
+	report := &LedgerReport{Username: username}
+
+	// read the player and its ledger at the same point in time
+	err := l.st.WithTx(ctx, func(ctx context.Context) error {
+		player, err := l.st.Players().Find(ctx, username)
+		if err != nil {
+			return err
+		}
+		entries, err := l.st.Ledger().All(ctx, username)
+		if err != nil {
+			return err
+		}
+
+		report.Stored = player.Resources()
+		report.Entries = entries
+		report.Ledger = core.Resources{}
+		for _, e := range entries {
+			report.Ledger = report.Ledger.Add(e.Delta)
+		}
+
+		if fix && !report.Matched() {
+			_, err = l.st.Players().RestoreResources(ctx, username, report.Ledger)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,57 @@
+package vanilla
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+func TestLedgerReplay(t *testing.T) {
+	st := newMemoryStorage()
+	ctx := context.Background()
+	createTestPlayer(t, st, "aspirin2d")
+
+	st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: 100, Wood: 20}, cause{Reason: "admin_grant"})
+	st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: -30}, cause{Reason: "build"})
+	st.Players().Update(ctx, "aspirin2d", cause{Reason: "recruit"}, func(p *core.Player) error {
+		p.Wood -= 5
+		return nil
+	})
+	// no resource changed, no entry
+	st.Players().Update(ctx, "aspirin2d", cause{Reason: "rename"}, func(p *core.Player) error {
+		p.DisplayName = "Aspirin"
+		return nil
+	})
+	// a failed spending leaves nothing behind
+	st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: -1000}, cause{Reason: "build"})
+
+	entries, err := st.Ledger().List(ctx, "aspirin2d", ledgerQuery{})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "recruit", entries[0].Reason)
+	assert.Equal(t, int64(-5), entries[0].Delta.Wood)
+
+	entries, _ = st.Ledger().List(ctx, "aspirin2d", ledgerQuery{Reason: "build"})
+	assert.Len(t, entries, 1)
+	entries, _ = st.Ledger().List(ctx, "aspirin2d", ledgerQuery{Before: entries[0].Version})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "admin_grant", entries[0].Reason)
+
+	l := &Ledger{st: st}
+	report, err := l.Replay(ctx, "aspirin2d", false)
+	assert.Nil(t, err)
+	assert.True(t, report.Matched())
+	assert.Equal(t, core.Resources{Gold: 70, Wood: 15}, report.Ledger)
+
+	// the balances went wrong somehow, rebuild them from the ledger
+	st.Players().RestoreResources(ctx, "aspirin2d", core.Resources{Gold: 1})
+	report, err = l.Replay(ctx, "aspirin2d", true)
+	assert.Nil(t, err)
+	assert.False(t, report.Matched())
+
+	p, _ := st.Players().Find(ctx, "aspirin2d")
+	assert.Equal(t, core.Resources{Gold: 70, Wood: 15}, p.Resources())
+}
@@ -0,0 +1,100 @@
+package vanilla
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the header carrying the request id, both ways
+	requestIDHeader = "X-Request-ID"
+	// the key of the request logger in the gin context
+	logKey = "log"
+)
+
+var (
+	// the request ids accepted from the client, anything else is replaced
+	requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// NewLogger writes to the out, at the level (debug, info, warn, error), in the format (text or json)
+func NewLogger(level, format string, out io.Writer) (*logrus.Logger, error) {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(out)
+	logger.SetLevel(lvl)
+
+	switch format {
+	case "", "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	return logger, nil
+}
+
+// a random id of the requests and the connections
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logMiddleware gives every request an id, taken from the X-Request-ID header if it's sane,
+// and a logger with the id, then logs the request when it's done,
+// the query is left out, it may carry a token
+func logMiddleware(logger *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newID()
+		}
+		c.Header(requestIDHeader, id)
+		c.Set(logKey, logger.WithField("request_id", id))
+
+		c.Next()
+
+		entry := requestLog(c).WithFields(logrus.Fields{
+			"method":  c.Request.Method,
+			"path":    c.Request.URL.Path,
+			"status":  c.Writer.Status(),
+			"latency": time.Since(start).String(),
+			"ip":      c.ClientIP(),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("errors", c.Errors.String())
+		}
+
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			entry.Error("request")
+		case status >= 400:
+			entry.Warn("request")
+		default:
+			entry.Info("request")
+		}
+	}
+}
+
+// requestLog is the logger of the request, with its id and the username once authorized
+func requestLog(c *gin.Context) *logrus.Entry {
+	if v, ok := c.Get(logKey); ok {
+		return v.(*logrus.Entry)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
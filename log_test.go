@@ -0,0 +1,61 @@
+package vanilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLog(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LogFormat = "json"
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	s.log.SetOutput(&buf)
+
+	// the request id of the client is kept
+	req, _ := http.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(requestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "abc-123", w.Header().Get(requestIDHeader))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "abc-123", line["request_id"])
+	assert.Equal(t, "aspirin2d", line["username"])
+	assert.Equal(t, "/api/me", line["path"])
+	assert.EqualValues(t, http.StatusOK, line["status"])
+
+	// a bogus one is replaced, and the token is never logged
+	buf.Reset()
+	req, _ = http.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", wsProtocol+", "+wsBearerPrefix+token)
+	req.Header.Set(requestIDHeader, "not a valid id")
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	id := w.Header().Get(requestIDHeader)
+	assert.NotEqual(t, "not a valid id", id)
+	assert.Contains(t, buf.String(), id)
+	assert.False(t, strings.Contains(buf.String(), token))
+
+	_, err = NewLogger("loud", "text", &buf)
+	assert.Error(t, err)
+}
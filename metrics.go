@@ -0,0 +1,144 @@
+package vanilla
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// metrics of a server, in a registry of its own, so two servers in one process don't collide
+type metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	wsConnections prometheus.Gauge
+	wsMessages    *prometheus.CounterVec
+	wsDrops       *prometheus.CounterVec
+	wsCoalesced   prometheus.Counter
+
+	bcryptDuration *prometheus.HistogramVec
+
+	mongoDuration *prometheus.HistogramVec
+	mongoErrors   *prometheus.CounterVec
+
+	brokerErrors *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vanilla_http_requests_total",
+			Help: "Number of the http requests, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "vanilla_http_request_duration_seconds",
+			Help:    "Latency of the http requests, by route, method and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+
+		wsConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "vanilla_ws_connections",
+			Help: "Number of the active websocket connections.",
+		}),
+		wsMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vanilla_ws_messages_total",
+			Help: "Number of the websocket messages, by direction (in or out) and type.",
+		}, []string{"direction", "type"}),
+		wsDrops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vanilla_ws_send_dropped_total",
+			Help: "Number of the outbound websocket messages dropped, by the reason: drop_oldest or disconnect when the send queue was full, or closed.",
+		}, []string{"reason"}),
+		wsCoalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "vanilla_ws_send_coalesced_total",
+			Help: "Number of the outbound websocket messages replaced by a newer one of the same key, before they were sent.",
+		}),
+
+		bcryptDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "vanilla_bcrypt_duration_seconds",
+			Help:    "Time spent in bcrypt, by operation (hash or compare).",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1},
+		}, []string{"op"}),
+
+		mongoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "vanilla_mongo_command_duration_seconds",
+			Help:    "Latency of the mongodb commands, by command.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"command"}),
+		mongoErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vanilla_mongo_command_errors_total",
+			Help: "Number of the failed mongodb commands, including write errors, by command.",
+		}, []string{"command"}),
+
+		brokerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vanilla_broker_errors_total",
+			Help: "Number of the failed presence and broker operations, by operation: join, leave, nodes, publish, receive, last_seen or drop.",
+		}, []string{"op"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration,
+		m.wsConnections, m.wsMessages, m.wsDrops, m.wsCoalesced,
+		m.bcryptDuration,
+		m.mongoDuration, m.mongoErrors,
+		m.brokerErrors,
+	)
+	return m
+}
+
+// the /metrics endpoint
+func (m *metrics) handler() gin.HandlerFunc {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// count and time every http request by its route pattern, so the path parameters don't explode the labels
+func (m *metrics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		m.httpRequests.WithLabelValues(route, c.Request.Method, status).Inc()
+		m.httpDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observe the time spent by the bcrypt op
+func (m *metrics) bcrypt(op string, start time.Time) {
+	m.bcryptDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// the mongodb command monitor which feeds the mongo metrics
+func (m *metrics) mongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			m.mongoDuration.WithLabelValues(e.CommandName).Observe(float64(e.DurationNanos) / 1e9)
+			// the write errors, such as duplicate keys, come with a succeeded command
+			if _, err := e.Reply.LookupErr("writeErrors"); err == nil {
+				m.mongoErrors.WithLabelValues(e.CommandName).Inc()
+			}
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			m.mongoDuration.WithLabelValues(e.CommandName).Observe(float64(e.DurationNanos) / 1e9)
+			m.mongoErrors.WithLabelValues(e.CommandName).Inc()
+		},
+	}
+}
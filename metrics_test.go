@@ -0,0 +1,39 @@
+package vanilla
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/players/aspirin2d", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	// labeled by the route pattern, not the path
+	assert.Contains(t, body, `vanilla_http_requests_total{method="GET",route="/api/players/:name",status="200"} 1`)
+	assert.Contains(t, body, `vanilla_http_requests_total{method="POST",route="/register",status="200"} 1`)
+	assert.Contains(t, body, `vanilla_bcrypt_duration_seconds_count{op="hash"} 1`)
+	assert.Contains(t, body, `vanilla_bcrypt_duration_seconds_count{op="compare"} 1`)
+	assert.Contains(t, body, "vanilla_ws_connections 0")
+}
@@ -0,0 +1,461 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/sirupsen/logrus"
+	core "github.com/sleep2death/vanilla/core"
+)
+
+const (
+	// time allowed to run all the pending migrations at startup
+	migrateTimeout = 5 * time.Minute
+	// a lock not renewed for this long is considered abandoned by a crashed instance
+	migrateLockTTL = time.Minute
+	// time between two renewals of the held lock
+	migrateLockRenew = migrateLockTTL / 3
+	// time to wait between two lock attempts
+	migrateLockRetry = 500 * time.Millisecond
+	// id of the only lock document
+	migrateLockID = "migrate"
+)
+
+var (
+	// migration version not registered
+	errUnknownMigration = errors.New("unknown migration version")
+	// the lock expired and was taken by another instance while migrating
+	errMigrateLockLost = errors.New("migration lock lost")
+)
+
+// migration changes the data shape from Version-1 to Version,
+// Down must revert what Up did
+type migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// all the migrations, in version order, never change a released one, add a new one instead
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "move player state into the players collection",
+		Up:          migratePlayers,
+		Down:        unmigratePlayers,
+	},
+	{
+		Version:     2,
+		Description: "add version to the players",
+		Up:          migratePlayerVersion,
+		Down:        unmigratePlayerVersion,
+	},
+	{
+		Version:     3,
+		Description: "open the ledger with the current balances",
+		Up:          migrateOpeningBalances,
+		Down:        unmigrateOpeningBalances,
+	},
+}
+
+// migration record, stored in the migrations collection
+type migrationRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	Applied     time.Time `bson:"applied"`
+}
+
+// MigrationStatus of a registered migration
+type MigrationStatus struct {
+	Version     int
+	Description string
+	// zero if the migration is not applied yet
+	Applied time.Time
+}
+
+// Migrator applies or reverts the migrations
+type Migrator struct {
+	db    *mongo.Database
+	owner string
+	log   logrus.FieldLogger
+
+	lockTTL   time.Duration
+	lockRenew time.Duration
+}
+
+// NewMigrator of the database
+func NewMigrator(db *mongo.Database) *Migrator {
+	host, _ := os.Hostname()
+	return &Migrator{
+		db:        db,
+		owner:     fmt.Sprintf("%s:%d", host, os.Getpid()),
+		log:       logrus.StandardLogger(),
+		lockTTL:   migrateLockTTL,
+		lockRenew: migrateLockRenew,
+	}
+}
+
+// OpenMigrator connects to the mongodb at addr, which must run the transactions,
+// without migrating anything
+func OpenMigrator(addr string) (*Migrator, error) {
+	ctx := context.Background()
+	db, err := connectDB(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransactions(ctx, db); err != nil {
+		db.Client().Disconnect(ctx)
+		return nil, err
+	}
+	return NewMigrator(db), nil
+}
+
+// Close the mongodb connection
+func (m *Migrator) Close(ctx context.Context) error {
+	return m.db.Client().Disconnect(ctx)
+}
+
+// Up applies all the pending migrations until the target version, 0 means the latest
+func (m *Migrator) Up(ctx context.Context, target int) error {
+	if target == 0 && len(migrations) > 0 {
+		target = migrations[len(migrations)-1].Version
+	}
+	if target != 0 && findMigration(target) == nil {
+		return errUnknownMigration
+	}
+
+	return m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range migrations {
+			if mig.Version > target {
+				break
+			}
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			m.log.WithField("version", mig.Version).Info("migrating up: ", mig.Description)
+			if err := mig.Up(ctx, m.db); err != nil {
+				return fmt.Errorf("migration %d up: %v", mig.Version, err)
+			}
+
+			rec := &migrationRecord{Version: mig.Version, Description: mig.Description, Applied: time.Now()}
+			if _, err := m.db.Collection(MigrationCollection).InsertOne(ctx, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts the last applied migrations, steps at most
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		versions := make([]int, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for i := 0; i < steps && i < len(versions); i++ {
+			mig := findMigration(versions[i])
+			if mig == nil {
+				return fmt.Errorf("migration %d down: %v", versions[i], errUnknownMigration)
+			}
+
+			m.log.WithField("version", mig.Version).Info("migrating down: ", mig.Description)
+			if err := mig.Down(ctx, m.db); err != nil {
+				return fmt.Errorf("migration %d down: %v", mig.Version, err)
+			}
+
+			if _, err := m.db.Collection(MigrationCollection).DeleteOne(ctx, bson.M{"_id": mig.Version}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Status of all the registered migrations, in version order
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, mig := range migrations {
+		s := MigrationStatus{Version: mig.Version, Description: mig.Description}
+		if rec, ok := applied[mig.Version]; ok {
+			s.Applied = rec.Applied
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// the applied migrations, by version
+func (m *Migrator) applied(ctx context.Context) (map[int]*migrationRecord, error) {
+	cur, err := m.db.Collection(MigrationCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	applied := make(map[int]*migrationRecord)
+	for cur.Next(ctx) {
+		rec := &migrationRecord{}
+		if err := cur.Decode(rec); err != nil {
+			return nil, err
+		}
+		applied[rec.Version] = rec
+	}
+	return applied, cur.Err()
+}
+
+// run the fn while holding the migration lock, so only one instance migrates at a time,
+// the lock is renewed until the fn returns, the ctx of the fn is canceled if it's lost
+func (m *Migrator) withLock(ctx context.Context, fn func(ctx context.Context) error) error {
+	locks := m.db.Collection(MigrationLockCollection)
+
+	for {
+		now := time.Now()
+		lock := bson.M{"_id": migrateLockID, "owner": m.owner, "expires": now.Add(m.lockTTL)}
+
+		// take the lock if nobody holds it, or the holder has not renewed it for too long
+		filter := bson.M{"_id": migrateLockID, "expires": bson.M{"$lt": now}}
+		opts := options.Replace().SetUpsert(true)
+		_, err := locks.ReplaceOne(ctx, filter, lock, opts)
+		if err == nil {
+			break
+		}
+		if !isDuplicateKey(err) {
+			return err
+		}
+
+		m.log.Info("waiting for the migration lock")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrateLockRetry):
+		}
+	}
+
+	defer func() {
+		// release the lock even if the ctx is done
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if _, err := locks.DeleteOne(ctx, bson.M{"_id": migrateLockID, "owner": m.owner}); err != nil {
+			m.log.WithError(err).Error("failed to release the migration lock")
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	lost := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.renewLock(ctx, lost, cancel)
+	}()
+
+	err := fn(ctx)
+	// stop renewing before the lock is released
+	cancel()
+	<-done
+	select {
+	case <-lost:
+		return errMigrateLockLost
+	default:
+		return err
+	}
+}
+
+// renew the held lock until the ctx is done, close the lost and cancel if another instance took it
+func (m *Migrator) renewLock(ctx context.Context, lost chan struct{}, cancel func()) {
+	locks := m.db.Collection(MigrationLockCollection)
+	ticker := time.NewTicker(m.lockRenew)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		filter := bson.M{"_id": migrateLockID, "owner": m.owner}
+		res, err := locks.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"expires": time.Now().Add(m.lockTTL)}})
+		if err != nil {
+			// try again on the next tick, the lock is still held until it expires
+			if ctx.Err() == nil {
+				m.log.WithError(err).Warn("failed to renew the migration lock")
+			}
+			continue
+		}
+		if res.MatchedCount == 0 {
+			m.log.Error("migration lock lost")
+			close(lost)
+			cancel()
+			return
+		}
+	}
+}
+
+func findMigration(version int) *migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
+
+// version 1: move the game state out of the old users documents into the players collection,
+// each user is migrated in its own transaction, so it's safe to run it again
+func migratePlayers(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection(UserCollection)
+	players := db.Collection(PlayerCollection)
+
+	// the old users may have no game state yet, so all of them need a player
+	cur, err := users.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		acc := &account{}
+		player := &core.Player{}
+		if err := cur.Decode(acc); err != nil {
+			return err
+		}
+		if err := cur.Decode(player); err != nil {
+			return err
+		}
+		if player.Created == 0 {
+			player.Created = time.Now().Unix()
+		}
+
+		err := db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+			_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+				opts := options.Update().SetUpsert(true)
+				filter := bson.M{"username": player.Username}
+				if _, err := players.UpdateOne(sc, filter, bson.M{"$setOnInsert": player}, opts); err != nil {
+					return nil, err
+				}
+
+				// keep the credentials only
+				_, err := users.ReplaceOne(sc, bson.M{"_id": acc.ID}, acc)
+				return nil, err
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// version 1 down: merge the players back into the users documents, then drop the players
+func unmigratePlayers(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection(UserCollection)
+	players := db.Collection(PlayerCollection)
+
+	cur, err := players.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		delete(doc, "_id")
+
+		if _, err := users.UpdateOne(ctx, bson.M{"username": doc["username"]}, bson.M{"$set": doc}); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	return players.Drop(ctx)
+}
+
+// version 2: the players need a version to be updated with compare-and-swap
+func migratePlayerVersion(ctx context.Context, db *mongo.Database) error {
+	filter := bson.M{"version": bson.M{"$exists": false}}
+	_, err := db.Collection(PlayerCollection).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"version": 0}})
+	return err
+}
+
+// version 2 down: remove the version of the players
+func unmigratePlayerVersion(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(PlayerCollection).UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"version": ""}})
+	return err
+}
+
+// version 3: the existing balances are the opening entries of the ledger, so it replays to the same balances
+func migrateOpeningBalances(ctx context.Context, db *mongo.Database) error {
+	ledger := db.Collection(LedgerCollection)
+	cause := cause{Reason: "opening_balance", Source: "migration:3"}
+
+	cur, err := db.Collection(PlayerCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		player := &core.Player{}
+		if err := cur.Decode(player); err != nil {
+			return err
+		}
+		if player.Resources().IsZero() {
+			continue
+		}
+
+		// skip the player if it's already opened
+		n, err := ledger.CountDocuments(ctx, bson.M{"username": player.Username})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+
+		if _, err := ledger.InsertOne(ctx, cause.entry(player, player.Resources())); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// version 3 down: remove the opening entries
+func unmigrateOpeningBalances(ctx context.Context, db *mongo.Database) error {
+	filter := bson.M{"reason": "opening_balance", "source": "migration:3"}
+	_, err := db.Collection(LedgerCollection).DeleteMany(ctx, filter)
+	return err
+}
@@ -0,0 +1,137 @@
+package vanilla
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+func TestMigrationsOrder(t *testing.T) {
+	last := 0
+	for _, mig := range migrations {
+		// versions must be unique and ascending
+		assert.True(t, mig.Version > last, "migration %d is out of order", mig.Version)
+		assert.NotEmpty(t, mig.Description)
+		assert.NotNil(t, mig.Up)
+		assert.NotNil(t, mig.Down)
+		last = mig.Version
+	}
+
+	assert.NotNil(t, findMigration(1))
+	assert.Nil(t, findMigration(last+1))
+}
+
+func TestMigrator(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	m := NewMigrator(db)
+
+	// a user of the old shape, with the game state in it
+	_, err := db.Collection(UserCollection).InsertOne(ctx, bson.M{
+		"_id":      primitive.NewObjectID(),
+		"username": "aspirin2d",
+		"email":    "aspirin2d@vanilla.com",
+		"gold":     50,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, errUnknownMigration, m.Up(ctx, len(migrations)+1))
+	assert.NoError(t, m.Up(ctx, 1))
+	status, err := m.Status(ctx)
+	assert.NoError(t, err)
+	assert.False(t, status[0].Applied.IsZero())
+	assert.True(t, status[1].Applied.IsZero())
+
+	// the rest of them, and again changes nothing
+	assert.NoError(t, m.Up(ctx, 0))
+	assert.NoError(t, m.Up(ctx, 0))
+	status, _ = m.Status(ctx)
+	for _, s := range status {
+		assert.False(t, s.Applied.IsZero(), "migration %d not applied", s.Version)
+	}
+
+	st := newMongoStorage(db)
+	p, err := st.Players().Find(ctx, "aspirin2d")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), p.Gold)
+	entries, err := st.Ledger().All(ctx, "aspirin2d")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, core.Resources{Gold: 50}, entries[0].Delta)
+	}
+
+	// all the way down, back to the old shape
+	assert.NoError(t, m.Down(ctx, len(migrations)))
+	status, _ = m.Status(ctx)
+	for _, s := range status {
+		assert.True(t, s.Applied.IsZero(), "migration %d not reverted", s.Version)
+	}
+	n, err := db.Collection(PlayerCollection).CountDocuments(ctx, bson.M{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	n, _ = db.Collection(LedgerCollection).CountDocuments(ctx, bson.M{})
+	assert.Equal(t, int64(0), n)
+	n, _ = db.Collection(UserCollection).CountDocuments(ctx, bson.M{"username": "aspirin2d", "gold": 50})
+	assert.Equal(t, int64(1), n)
+}
+
+func TestMigrationLock(t *testing.T) {
+	db := testMongo(t)
+
+	a := NewMigrator(db)
+	a.owner = "a"
+	a.lockTTL = time.Second
+	a.lockRenew = time.Millisecond * 200
+	b := NewMigrator(db)
+	b.owner = "b"
+	b.lockTTL = time.Second
+
+	// held by a longer than the ttl, b waits until its ctx is done
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- a.withLock(context.Background(), func(ctx context.Context) error {
+			close(holding)
+			<-release
+			return ctx.Err()
+		})
+	}()
+	<-holding
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.lockTTL*3)
+	err := b.withLock(ctx, func(ctx context.Context) error {
+		t.Error("b took the lock held by a")
+		return nil
+	})
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// released, b takes it
+	close(release)
+	assert.NoError(t, <-result)
+	assert.NoError(t, b.withLock(context.Background(), func(ctx context.Context) error { return nil }))
+
+	// a crashed holder, b takes it once it's expired
+	locks := db.Collection(MigrationLockCollection)
+	_, err = locks.InsertOne(context.Background(), bson.M{"_id": migrateLockID, "owner": "crashed", "expires": time.Now().Add(a.lockTTL)})
+	assert.NoError(t, err)
+	start := time.Now()
+	assert.NoError(t, b.withLock(context.Background(), func(ctx context.Context) error { return nil }))
+	assert.True(t, time.Since(start) >= time.Millisecond*500)
+
+	// taken over while migrating, the migration is canceled
+	err = a.withLock(context.Background(), func(ctx context.Context) error {
+		_, err := locks.UpdateOne(ctx, bson.M{"_id": migrateLockID}, bson.M{"$set": bson.M{"owner": "b"}})
+		assert.NoError(t, err)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Equal(t, errMigrateLockLost, err)
+}
@@ -0,0 +1,280 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+// the categories of the notifications
+const (
+	notifyBuild  = "build"
+	notifyAttack = "attack"
+	notifyGrant  = "grant"
+	notifySystem = "system"
+)
+
+var notificationCategories = []string{notifyBuild, notifyAttack, notifyGrant, notifySystem}
+
+// the cause of the resources granted by the admins
+const reasonAdminGrant = "admin_grant"
+
+var (
+	// not one of the notificationCategories
+	errNotificationCategory = errors.New("unknown notification category")
+)
+
+func validCategory(category string) bool {
+	for _, c := range notificationCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// notifier keeps the notifications in the inboxes of the players, and pushes them to the ones online,
+// as the preferences of the categories allow
+type notifier struct {
+	hub   *hub
+	store notificationStore
+	log   logrus.FieldLogger
+}
+
+func newNotifier(h *hub, store notificationStore, log logrus.FieldLogger) *notifier {
+	return &notifier{hub: h, store: store, log: log}
+}
+
+// notify the player of the notification, its id and time are set here,
+// the offline players find it in the inbox later
+func (nf *notifier) notify(ctx context.Context, n *core.Notification) error {
+	if !validCategory(n.Category) {
+		return errNotificationCategory
+	}
+	prefs, err := nf.store.Prefs(ctx, n.Username)
+	if err != nil {
+		return err
+	}
+	pref := prefs.Pref(n.Category)
+
+	n.ID, n.Time = primitive.NewObjectID(), time.Now().UTC().Truncate(time.Millisecond)
+	if pref.Inbox {
+		if err := nf.store.Add(ctx, n); err != nil {
+			return err
+		}
+	}
+	if pref.Push {
+		return nf.hub.sendTo(ctx, n.Username, "notification", n)
+	}
+	return nil
+}
+
+// added tells the player of the resources granted by the admins, in the background,
+// the storage calls it once they're saved
+func (nf *notifier) added(p *core.Player, delta core.Resources, c cause) {
+	if c.Reason != reasonAdminGrant {
+		return
+	}
+	n := &core.Notification{Username: p.Username, Category: notifyGrant, Title: "resources granted", Data: resourceData(delta)}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := nf.notify(ctx, n); err != nil {
+			nf.log.WithError(err).WithField("username", n.Username).Warn("failed to notify the grant")
+		}
+	}()
+}
+
+// the non-zero resources by name
+func resourceData(r core.Resources) map[string]string {
+	data := make(map[string]string)
+	for _, res := range []struct {
+		name string
+		n    int64
+	}{
+		{"gold", r.Gold},
+		{"food", r.Food},
+		{"wood", r.Wood},
+		{"stone", r.Stone},
+		{"iron", r.Iron},
+		{"crystal", r.Crystal},
+	} {
+		if res.n != 0 {
+			data[res.name] = strconv.FormatInt(res.n, 10)
+		}
+	}
+	return data
+}
+
+// every category with the preference of the player
+func allPrefs(prefs *core.NotificationPrefs) map[string]core.NotificationPref {
+	all := make(map[string]core.NotificationPref, len(notificationCategories))
+	for _, c := range notificationCategories {
+		all[c] = prefs.Pref(c)
+	}
+	return all
+}
+
+// get the notifications of the caller, newest first, like ?before=<id>&limit=20&unread=true
+func getNotificationsHandler(store notificationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var q notificationQuery
+		var err error
+		if before := c.Query("before"); len(before) > 0 {
+			if q.Before, err = primitive.ObjectIDFromHex(before); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal before",
+				})
+				return
+			}
+		}
+		if limit := c.Query("limit"); len(limit) > 0 {
+			if q.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal limit",
+				})
+				return
+			}
+		}
+		if unread := c.Query("unread"); len(unread) > 0 {
+			if q.Unread, err = strconv.ParseBool(unread); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal unread",
+				})
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		list, err := store.List(ctx, c.GetString("username"), q)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to list the notifications")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// mark the notifications of the ids read, or all of them without any id
+func getMarkReadHandler(store notificationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var json struct {
+			IDs []string `json:"ids"`
+		}
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		ids := make([]primitive.ObjectID, 0, len(json.IDs))
+		for _, s := range json.IDs {
+			id, err := primitive.ObjectIDFromHex(s)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal ids",
+				})
+				return
+			}
+			ids = append(ids, id)
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		changed, err := store.MarkRead(ctx, c.GetString("username"), ids)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to mark the notifications read")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"updated": changed})
+	}
+}
+
+// delete the notification of the caller
+func getDeleteNotificationHandler(store notificationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err == nil {
+			err = store.Delete(ctx, c.GetString("username"), id)
+		} else {
+			err = errNotFound
+		}
+		if err == errNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"reason": "notification not found",
+			})
+			return
+		}
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to delete the notification")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// get the preferences of every category
+func getNotificationPrefsHandler(store notificationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		prefs, err := store.Prefs(ctx, c.GetString("username"))
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to get the notification preferences")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, allPrefs(prefs))
+	}
+}
+
+// set the preferences of the categories given, like {"attack": {"inbox": true, "push": false}}
+func getUpdateNotificationPrefsHandler(store notificationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var json map[string]core.NotificationPref
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		for category := range json {
+			if !validCategory(category) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"reason": "illigal category",
+				})
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		prefs, err := store.SetPrefs(ctx, c.GetString("username"), json)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to set the notification preferences")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, allPrefs(prefs))
+	}
+}
@@ -0,0 +1,150 @@
+package vanilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+func TestNotifications(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var rb []byte
+		if body != nil {
+			rb, _ = json.Marshal(body)
+		}
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(rb))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+	list := func(path string) []*core.Notification {
+		w := request("GET", path, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var list []*core.Notification
+		json.NewDecoder(w.Body).Decode(&list)
+		return list
+	}
+
+	// offline, kept in the inbox
+	ctx := context.Background()
+	assert.NoError(t, s.notifier.notify(ctx, &core.Notification{Username: "aspirin2d", Category: notifyBuild, Title: "farm built"}))
+	assert.Equal(t, errNotificationCategory, s.notifier.notify(ctx, &core.Notification{Username: "aspirin2d", Category: "gossip"}))
+
+	// online, pushed too
+	conn, _, err := dialWS(websocket.DefaultDialer, "ws://"+s.Addr()+"/ws", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readConnected(t, conn, jsonCodec{})
+
+	attack := &core.Notification{Username: "aspirin2d", Category: notifyAttack, Title: "tile attacked", Data: map[string]string{"tid": "t1"}}
+	assert.NoError(t, s.notifier.notify(ctx, attack))
+	pushed := readType(t, conn, "notification")
+	assert.Equal(t, attack.ID.Hex(), pushed["id"])
+	assert.Equal(t, map[string]interface{}{"tid": "t1"}, pushed["data"])
+
+	notes := list("/api/me/notifications")
+	if assert.Len(t, notes, 2) {
+		assert.Equal(t, "tile attacked", notes[0].Title)
+		assert.Equal(t, "farm built", notes[1].Title)
+	}
+	assert.Len(t, list("/api/me/notifications?limit=1"), 1)
+	assert.Len(t, list("/api/me/notifications?before="+notes[0].ID.Hex()), 1)
+
+	// read one, then all
+	w := request("POST", "/api/me/notifications/read", gin.H{"ids": []string{notes[0].ID.Hex()}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"updated": 1}`, w.Body.String())
+	unread := list("/api/me/notifications?unread=true")
+	if assert.Len(t, unread, 1) {
+		assert.Equal(t, notes[1].ID, unread[0].ID)
+	}
+	w = request("POST", "/api/me/notifications/read", gin.H{})
+	assert.JSONEq(t, `{"updated": 1}`, w.Body.String())
+	assert.Empty(t, list("/api/me/notifications?unread=true"))
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/api/me/notifications/read", gin.H{"ids": []string{"nope"}}).Code)
+
+	assert.Equal(t, http.StatusNoContent, request("DELETE", "/api/me/notifications/"+notes[1].ID.Hex(), nil).Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/api/me/notifications/"+notes[1].ID.Hex(), nil).Code)
+	assert.Len(t, list("/api/me/notifications"), 1)
+
+	// no push for the attacks, nothing at all for the grants
+	w = request("PUT", "/api/me/notification-prefs", map[string]core.NotificationPref{
+		notifyAttack: {Inbox: true},
+		notifyGrant:  {},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var prefs map[string]core.NotificationPref
+	json.NewDecoder(w.Body).Decode(&prefs)
+	assert.Equal(t, map[string]core.NotificationPref{
+		notifyBuild:  {Inbox: true, Push: true},
+		notifyAttack: {Inbox: true},
+		notifyGrant:  {},
+		notifySystem: {Inbox: true, Push: true},
+	}, prefs)
+	assert.Equal(t, http.StatusBadRequest, request("PUT", "/api/me/notification-prefs", gin.H{"gossip": gin.H{}}).Code)
+
+	assert.NoError(t, s.notifier.notify(ctx, &core.Notification{Username: "aspirin2d", Category: notifyGrant, Title: "gold granted"}))
+	assert.NoError(t, s.notifier.notify(ctx, &core.Notification{Username: "aspirin2d", Category: notifyAttack, Title: "attacked again"}))
+	assert.NoError(t, s.notifier.notify(ctx, &core.Notification{Username: "aspirin2d", Category: notifySystem, Title: "maintenance"}))
+	assert.Equal(t, "maintenance", readType(t, conn, "notification")["title"])
+
+	notes = list("/api/me/notifications")
+	if assert.Len(t, notes, 3) {
+		assert.Equal(t, "maintenance", notes[0].Title)
+		assert.Equal(t, "attacked again", notes[1].Title)
+	}
+}
+
+func TestNotificationsGrant(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialWS(websocket.DefaultDialer, "ws://"+s.Addr()+"/ws", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readConnected(t, conn, jsonCodec{})
+
+	// the builds are not granted, only the admin grants are told
+	ctx := context.Background()
+	_, err = s.st.Players().AddResources(ctx, "aspirin2d", core.Resources{Wood: 5}, cause{Reason: "build"})
+	assert.NoError(t, err)
+	_, err = s.st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: 100}, cause{Reason: reasonAdminGrant})
+	assert.NoError(t, err)
+
+	// after the patches of the player
+	var env envelope
+	for env.Type != "notification" {
+		env = envelope{}
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pushed, _ := env.Data.(map[string]interface{})
+	assert.Equal(t, notifyGrant, pushed["category"])
+	assert.Equal(t, map[string]interface{}{"gold": "100"}, pushed["data"])
+}
@@ -0,0 +1,307 @@
+package vanilla
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+const (
+	// the subject of the changed players to the nodes holding their connections, followed by the node id
+	subjectPlayer = "player."
+
+	// the changes waiting to be published, at most
+	playerChangesSize = 1024
+)
+
+// playerSync pushes the state of the players to their own connections: a snapshot when one connects,
+// or asks for it, then a patch of every change, from the version the connection has to the new one
+type playerSync struct {
+	hub     *hub
+	players playerStore
+
+	// the changed players, published in the background
+	changes chan *core.Player
+
+	mu sync.Mutex
+	// the players connected to this node
+	states map[string]*syncState
+}
+
+// syncState of a player, as last pushed to its connections
+type syncState struct {
+	// the player is being loaded, no snapshot is pushed yet
+	loading bool
+	version int64
+	// the player as the generic json, which the patches are made against
+	doc     interface{}
+	player  *core.Player
+	clients map[*client]struct{}
+}
+
+// the data of the player message, the whole state
+type playerSnapshot struct {
+	Version int64        `json:"version"`
+	Player  *core.Player `json:"player"`
+}
+
+// the data of the player.patch message, the client applies it only if it has the From version,
+// otherwise it sends player.sync for a snapshot
+type playerPatch struct {
+	From    int64     `json:"from"`
+	Version int64     `json:"version"`
+	Ops     []patchOp `json:"ops"`
+}
+
+// patchOp is an operation of the json patch, RFC 6902, on the json of the player
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// the data of the player.sync message, a snapshot is pushed if the version is not the latest
+type playerSyncData struct {
+	Version int64 `json:"version"`
+}
+
+// newPlayerSync observes the connections of the hub, call it before serving
+func newPlayerSync(h *hub) *playerSync {
+	ps := &playerSync{
+		hub:     h,
+		changes: make(chan *core.Player, playerChangesSize),
+		states:  make(map[string]*syncState),
+	}
+	h.observe(ps.connect, ps.disconnect)
+	h.handle("player.sync", ps.handleSync)
+	return ps
+}
+
+// start receiving the changes of the cluster, the snapshots are loaded from the players
+func (ps *playerSync) start(ctx context.Context, players playerStore) error {
+	ps.players = players
+	if err := ps.hub.broker.Subscribe(ctx, subjectPlayer+ps.hub.node, ps.receive); err != nil {
+		return err
+	}
+	go ps.publisher()
+	return nil
+}
+
+// changed is called by the storage after the player is saved, it never waits for the broker:
+// a change dropped when too many are waiting is not lost, the patch of the next one carries it too
+func (ps *playerSync) changed(p *core.Player) {
+	select {
+	case ps.changes <- p:
+	default:
+		ps.hub.metrics.brokerErrors.WithLabelValues("drop").Inc()
+	}
+}
+
+// publisher publishes the changes in order, until the hub is stopped
+func (ps *playerSync) publisher() {
+	for {
+		select {
+		case <-ps.hub.stop:
+			return
+		case p := <-ps.changes:
+			ps.publish(p)
+		}
+	}
+}
+
+// publish the change to the nodes holding the connections of the player,
+// a node it connects to later loads the saved player anyway
+func (ps *playerSync) publish(p *core.Player) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	nodes, err := ps.hub.broker.Nodes(ctx, p.Username)
+	if err != nil {
+		ps.hub.metrics.brokerErrors.WithLabelValues("nodes").Inc()
+		return
+	}
+	if len(nodes) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(p)
+	if err != nil {
+		ps.hub.metrics.brokerErrors.WithLabelValues("publish").Inc()
+		return
+	}
+	for node := range nodes {
+		if node == ps.hub.node {
+			ps.receive(payload)
+			continue
+		}
+		if err := ps.hub.broker.Publish(ctx, subjectPlayer+node, payload); err != nil {
+			ps.hub.metrics.brokerErrors.WithLabelValues("publish").Inc()
+		}
+	}
+}
+
+// receive the changed player, and push the patch to its local connections,
+// the changes older than the state pushed are stale
+func (ps *playerSync) receive(payload []byte) {
+	var p core.Player
+	if err := json.Unmarshal(payload, &p); err != nil {
+		ps.hub.metrics.brokerErrors.WithLabelValues("receive").Inc()
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	st, ok := ps.states[p.Username]
+	if !ok || p.Version <= st.version {
+		return
+	}
+	if st.loading {
+		// newer than the one being loaded, the snapshot is pushed from it
+		st.version, st.doc, st.player = p.Version, jsonDoc(&p), &p
+		return
+	}
+	doc := jsonDoc(&p)
+	patch := &playerPatch{From: st.version, Version: p.Version, Ops: diff("", st.doc, doc, []patchOp{})}
+	st.version, st.doc, st.player = p.Version, doc, &p
+	for c := range st.clients {
+		c.push("player.patch", patch)
+	}
+}
+
+// connect pushes the snapshot to the client, loaded if the player has no other connection here,
+// the state is there before it's loaded, so the changes meanwhile are not missed
+func (ps *playerSync) connect(c *client) {
+	ps.mu.Lock()
+	st, ok := ps.states[c.username]
+	if !ok {
+		st = &syncState{loading: true, version: -1, clients: make(map[*client]struct{})}
+		ps.states[c.username] = st
+	}
+	st.clients[c] = struct{}{}
+	if !st.loading {
+		c.push("player", &playerSnapshot{Version: st.version, Player: st.player})
+	}
+	ps.mu.Unlock()
+	// loaded by another connection
+	if ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	player, err := ps.players.Find(ctx, c.username)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// every connection is gone meanwhile
+	if ps.states[c.username] != st {
+		return
+	}
+	if err != nil {
+		// the connections ask for it again with player.sync
+		c.log.WithError(err).Warn("failed to load the player to sync")
+		delete(ps.states, c.username)
+		return
+	}
+	if player.Version > st.version {
+		st.version, st.doc, st.player = player.Version, jsonDoc(player), player
+	}
+	st.loading = false
+	for c := range st.clients {
+		c.push("player", &playerSnapshot{Version: st.version, Player: st.player})
+	}
+}
+
+// disconnect forgets the player with no more connections here
+func (ps *playerSync) disconnect(c *client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	st, ok := ps.states[c.username]
+	if !ok {
+		return
+	}
+	delete(st.clients, c)
+	if len(st.clients) == 0 {
+		delete(ps.states, c.username)
+	}
+}
+
+// handleSync pushes the snapshot, if the client doesn't have the latest version
+func (ps *playerSync) handleSync(ctx context.Context, c *client, m *message) error {
+	var data playerSyncData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+
+	ps.mu.Lock()
+	st, ok := ps.states[c.username]
+	// the snapshot is pushed once loaded
+	if ok && !st.loading && st.version != data.Version {
+		c.push("player", &playerSnapshot{Version: st.version, Player: st.player})
+	}
+	ps.mu.Unlock()
+
+	if !ok {
+		// failed to load at connect
+		ps.connect(c)
+	}
+	return nil
+}
+
+// the player as the generic json
+func jsonDoc(p *core.Player) interface{} {
+	js, _ := json.Marshal(p)
+	var doc interface{}
+	json.Unmarshal(js, &doc)
+	return doc
+}
+
+// diff appends the operations from a to b at the path, the objects are compared by their members,
+// anything else is replaced as a whole
+func diff(path string, a, b interface{}, ops []patchOp) []patchOp {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if !reflect.DeepEqual(a, b) {
+			ops = append(ops, patchOp{Op: "replace", Path: path, Value: b})
+		}
+		return ops
+	}
+
+	for _, k := range sortedKeys(am) {
+		p := path + "/" + escapePointer(k)
+		if bv, ok := bm[k]; ok {
+			ops = diff(p, am[k], bv, ops)
+		} else {
+			ops = append(ops, patchOp{Op: "remove", Path: p})
+		}
+	}
+	for _, k := range sortedKeys(bm) {
+		if _, ok := am[k]; !ok {
+			ops = append(ops, patchOp{Op: "add", Path: path + "/" + escapePointer(k), Value: bm[k]})
+		}
+	}
+	return ops
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escape the member name in the json pointer, RFC 6901
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,169 @@
+package vanilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+func TestDiff(t *testing.T) {
+	var a, b interface{}
+	json.Unmarshal([]byte(`{"a": 1, "b": {"c": [1], "d": "x"}, "e/f": 1}`), &a)
+	json.Unmarshal([]byte(`{"a": 1, "b": {"c": [1, 2]}, "g": null}`), &b)
+
+	assert.Equal(t, []patchOp{
+		{Op: "replace", Path: "/b/c", Value: []interface{}{float64(1), float64(2)}},
+		{Op: "remove", Path: "/b/d"},
+		{Op: "remove", Path: "/e~1f"},
+		{Op: "add", Path: "/g"},
+	}, diff("", a, b, nil))
+	assert.Empty(t, diff("", a, a, nil))
+}
+
+func TestPlayerSync(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialWS(websocket.DefaultDialer, "ws://"+s.Addr()+"/ws", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readSession(t, conn, jsonCodec{})
+
+	var snapshot struct {
+		Type string
+		Data playerSnapshot
+	}
+	assert.NoError(t, conn.ReadJSON(&snapshot))
+	assert.Equal(t, "player", snapshot.Type)
+	assert.Equal(t, "aspirin2d", snapshot.Data.Player.Username)
+	version := snapshot.Data.Version
+
+	readPatch := func() playerPatch {
+		var env struct {
+			Type string
+			Data playerPatch
+		}
+		assert.NoError(t, conn.ReadJSON(&env))
+		assert.Equal(t, "player.patch", env.Type)
+		// the last seen is set in the background, it may come with any patch
+		ops := env.Data.Ops[:0]
+		for _, op := range env.Data.Ops {
+			if op.Path != "/lastSeen" {
+				ops = append(ops, op)
+			}
+		}
+		env.Data.Ops = ops
+		return env.Data
+	}
+
+	// every mutation path
+	ctx := context.Background()
+	players := s.st.Players()
+	_, err = players.AddResources(ctx, "aspirin2d", core.Resources{Gold: 10}, cause{Reason: "build"})
+	assert.NoError(t, err)
+	assert.Equal(t, playerPatch{From: version, Version: version + 1, Ops: []patchOp{
+		{Op: "replace", Path: "/gold", Value: float64(10)},
+		{Op: "replace", Path: "/version", Value: float64(version + 1)},
+	}}, readPatch())
+
+	rb, _ := json.Marshal(gin.H{"displayName": "Aspirin"})
+	req, _ := http.NewRequest("PATCH", "/api/me", bytes.NewBuffer(rb))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, patchOp{Op: "replace", Path: "/displayName", Value: "Aspirin"}, readPatch().Ops[0])
+
+	// nothing from the rolled back transaction, the committed one after it
+	err = s.st.WithTx(ctx, func(ctx context.Context) error {
+		players.AddResources(ctx, "aspirin2d", core.Resources{Gold: 5}, cause{Reason: "build"})
+		return errors.New("rolled back")
+	})
+	assert.Error(t, err)
+	assert.NoError(t, s.st.WithTx(ctx, func(ctx context.Context) error {
+		_, err := players.Update(ctx, "aspirin2d", cause{Reason: "build"}, func(p *core.Player) error {
+			p.Wood = 3
+			return nil
+		})
+		return err
+	}))
+	patch := readPatch()
+	assert.Equal(t, version+2, patch.From)
+	assert.Equal(t, version+3, patch.Version)
+
+	// behind, so the whole state again
+	conn.WriteJSON(gin.H{"type": "player.sync", "data": playerSyncData{Version: version}})
+	assert.NoError(t, conn.ReadJSON(&snapshot))
+	assert.Equal(t, "player", snapshot.Type)
+	assert.Equal(t, version+3, snapshot.Data.Version)
+	assert.Equal(t, int64(10), snapshot.Data.Player.Gold)
+	assert.Equal(t, int64(3), snapshot.Data.Player.Wood)
+}
+
+// a player store whose finds return the player once released
+type slowFindPlayers struct {
+	playerStore
+	player  *core.Player
+	release chan struct{}
+}
+
+func (s *slowFindPlayers) Find(ctx context.Context, username string) (*core.Player, error) {
+	<-s.release
+	return s.player, nil
+}
+
+func TestPlayerSyncConnectRace(t *testing.T) {
+	h := newHub(DefaultWSConfig(), newMetrics(), trace.NewNoopTracerProvider().Tracer(""), nil, newMemoryBroker())
+	ps := newPlayerSync(h)
+	players := &slowFindPlayers{player: &core.Player{Username: "aspirin2d", Version: 1}, release: make(chan struct{})}
+	ps.players = players
+
+	c := newTestClient(h)
+	c.username = "aspirin2d"
+	done := make(chan struct{})
+	go func() {
+		ps.connect(c)
+		close(done)
+	}()
+
+	// changed while it's loaded
+	assert.Eventually(t, func() bool {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		return ps.states["aspirin2d"] != nil
+	}, time.Second, time.Millisecond*10)
+	payload, _ := json.Marshal(&core.Player{Username: "aspirin2d", Version: 2, Gold: 10})
+	ps.receive(payload)
+	close(players.release)
+	<-done
+
+	items := c.queue.take()
+	if assert.Len(t, items, 1) {
+		var env struct {
+			Type string
+			Data playerSnapshot
+		}
+		json.Unmarshal(items[0].frame, &env)
+		assert.Equal(t, "player", env.Type)
+		assert.Equal(t, int64(2), env.Data.Version)
+		assert.Equal(t, int64(10), env.Data.Player.Gold)
+	}
+}
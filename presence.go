@@ -0,0 +1,422 @@
+package vanilla
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// the statuses of the users
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+	// only the detached sessions of the user are on the node, offline to the others,
+	// but the messages to the user still reach the node
+	statusDetached = "detached"
+
+	// the subject of the status changes, to the watchers on every node
+	subjectPresence = "presence"
+
+	// the users one connection can watch, at most
+	maxPresenceWatch = 200
+	// the users of one presence query, at most
+	maxPresenceQuery = 100
+)
+
+var (
+	// the status set by the client is not online or away
+	errPresenceStatus = errors.New("status must be online or away")
+	// watching too many users
+	errPresenceWatch = errors.New("too many users to watch")
+	// the presence of the others is private
+	errPresenceMates = errors.New("only the guild mates can be watched")
+)
+
+// presenceData of a user, pushed to the watchers as "presence", and returned by the query
+type presenceData struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	// unix seconds the user last connected or disconnected, 0 if unknown
+	LastSeen int64 `json:"lastSeen,omitempty"`
+}
+
+// the data of the presence.status message, the client is away when hidden or idle
+type presenceStatusData struct {
+	Status string `json:"status"`
+}
+
+// the data of the presence.watch and presence.unwatch messages, the users are the guild mates of the player
+type presenceWatchData struct {
+	Usernames []string `json:"usernames"`
+}
+
+// the status of the user on this node, empty if it has no session here:
+// online if any connection is neither set away nor idle for AwayAfter,
+// detached if there is no connection, but a session to resume
+func (h *hub) localStatus(username string) string {
+	status := ""
+	for _, c := range h.local(username) {
+		if c.active(h.cfg.AwayAfter) {
+			return statusOnline
+		}
+		status = statusAway
+	}
+	if len(status) == 0 && len(h.sessionsOf(username)) > 0 {
+		return statusDetached
+	}
+	return status
+}
+
+// the status seen by the others, the detached sessions are offline
+func visibleStatus(status string) string {
+	if status == statusDetached {
+		return ""
+	}
+	return status
+}
+
+// refresh the presence of the user in the background, called when the user connects or disconnects,
+// its activity changes, and by the heartbeat: a worker of the user does the refreshes one at a time,
+// so the broker sees its changes in order, and the refreshes asked meanwhile are done once after it
+func (h *hub) refresh(username string) {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+
+	if _, ok := h.refreshing[username]; ok {
+		h.refreshing[username] = true
+		return
+	}
+	h.refreshing[username] = false
+	go h.refreshWorker(username)
+}
+
+// refreshWorker refreshes the user until no more refresh is asked
+func (h *hub) refreshWorker(username string) {
+	for {
+		h.update(username)
+
+		h.presenceMu.Lock()
+		if !h.refreshing[username] {
+			delete(h.refreshing, username)
+			h.presenceMu.Unlock()
+			break
+		}
+		h.refreshing[username] = false
+		h.presenceMu.Unlock()
+	}
+
+	select {
+	case h.refreshed <- struct{}{}:
+	default:
+	}
+}
+
+// wait until every refresh asked is done
+func (h *hub) waitRefreshes() {
+	for {
+		h.presenceMu.Lock()
+		n := len(h.refreshing)
+		h.presenceMu.Unlock()
+		if n == 0 {
+			return
+		}
+		<-h.refreshed
+	}
+}
+
+// update the presence of the user on this node, and tell the watchers if the status is changed,
+// only its worker calls it
+func (h *hub) update(username string) {
+	status := h.localStatus(username)
+	h.presenceMu.Lock()
+	last := h.statuses[username]
+	if len(status) == 0 {
+		delete(h.statuses, username)
+	} else {
+		h.statuses[username] = status
+	}
+	h.presenceMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if len(status) == 0 {
+		if len(last) > 0 {
+			if err := h.broker.Leave(ctx, username, h.node); err != nil {
+				h.metrics.brokerErrors.WithLabelValues("leave").Inc()
+			}
+		}
+	} else {
+		// renew it anyway
+		if err := h.broker.Join(ctx, username, h.node, status, h.cfg.PresenceTTL); err != nil {
+			h.metrics.brokerErrors.WithLabelValues("join").Inc()
+		}
+	}
+	if visibleStatus(status) == visibleStatus(last) {
+		return
+	}
+
+	p := &presenceData{Username: username}
+	if len(visibleStatus(last)) == 0 || len(visibleStatus(status)) == 0 {
+		// connected or disconnected
+		p.LastSeen = time.Now().Unix()
+		if h.players != nil {
+			if err := h.players.SetLastSeen(ctx, username, p.LastSeen); err != nil && err != errNotFound {
+				h.metrics.brokerErrors.WithLabelValues("last_seen").Inc()
+			}
+		}
+	}
+
+	// the status of the whole cluster
+	nodes, err := h.broker.Nodes(ctx, username)
+	if err != nil {
+		h.metrics.brokerErrors.WithLabelValues("nodes").Inc()
+		return
+	}
+	p.Status = clusterStatus(nodes)
+
+	payload, _ := json.Marshal(p)
+	if err := h.broker.Publish(ctx, subjectPresence, payload); err != nil {
+		h.metrics.brokerErrors.WithLabelValues("publish").Inc()
+	}
+}
+
+// online on any node, or away on every node connected, or offline
+func clusterStatus(nodes map[string]string) string {
+	status := statusOffline
+	for _, s := range nodes {
+		switch s {
+		case statusOnline:
+			return statusOnline
+		case statusAway:
+			status = statusAway
+		}
+	}
+	return status
+}
+
+// receivePresence pushes the status change to the local watchers,
+// a pending one of the same user is stale, only the latest is sent
+func (h *hub) receivePresence(payload []byte) {
+	var p presenceData
+	if err := json.Unmarshal(payload, &p); err != nil {
+		h.metrics.brokerErrors.WithLabelValues("receive").Inc()
+		return
+	}
+	for _, c := range h.local("") {
+		if c.watches(p.Username) {
+			c.pushKeyed(presenceKey(p.Username), "presence", &p)
+		}
+	}
+}
+
+// the key of the presence messages of the user in the send queue
+func presenceKey(username string) string {
+	return "presence:" + username
+}
+
+// mates of the viewer among the users, who may see the presence of each other:
+// the viewer itself, and the players of its guild, with the last seen in the store
+func (h *hub) mates(ctx context.Context, viewer string, usernames []string) (map[string]int64, error) {
+	mates := map[string]int64{viewer: 0}
+	if h.players == nil {
+		return mates, nil
+	}
+	me, err := h.players.Find(ctx, viewer)
+	if err != nil {
+		if err == errNotFound {
+			return mates, nil
+		}
+		return nil, err
+	}
+	mates[viewer] = me.LastSeen
+	if len(me.Guild) == 0 {
+		return mates, nil
+	}
+
+	players, err := h.players.GuildMates(ctx, me.Guild, usernames)
+	if err != nil {
+		return nil, err
+	}
+	for _, player := range players {
+		mates[player.Username] = player.LastSeen
+	}
+	return mates, nil
+}
+
+// whether all the users are the mates
+func allMates(usernames []string, mates map[string]int64) bool {
+	for _, username := range usernames {
+		if _, ok := mates[username]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// presence of the mates, cluster-wide, with the last seen of the offline ones
+func (h *hub) presence(ctx context.Context, usernames []string, mates map[string]int64) ([]*presenceData, error) {
+	list := make([]*presenceData, 0, len(usernames))
+	for _, username := range usernames {
+		nodes, err := h.broker.Nodes(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		p := &presenceData{Username: username, Status: clusterStatus(nodes)}
+		if p.Status == statusOffline {
+			p.LastSeen = mates[username]
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// heartbeat renews the presence of the local users before it expires, and turns the idle ones away
+func (h *hub) heartbeat() {
+	ticker := time.NewTicker(h.cfg.PresenceTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.presenceMu.Lock()
+			users := make([]string, 0, len(h.statuses))
+			for username := range h.statuses {
+				users = append(users, username)
+			}
+			h.presenceMu.Unlock()
+
+			for _, username := range users {
+				h.refresh(username)
+			}
+		}
+	}
+}
+
+// handlePresenceStatus sets the connection away or back online
+func handlePresenceStatus(ctx context.Context, c *client, m *message) error {
+	var data presenceStatusData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+	if data.Status != statusOnline && data.Status != statusAway {
+		return errPresenceStatus
+	}
+
+	c.mu.Lock()
+	c.away = data.Status == statusAway
+	c.mu.Unlock()
+	c.hub.refresh(c.username)
+	return nil
+}
+
+// handlePresenceWatch watches the status changes of the users, and sends their current presence
+func handlePresenceWatch(ctx context.Context, c *client, m *message) error {
+	var data presenceWatchData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+
+	c.mu.Lock()
+	added := 0
+	for _, username := range data.Usernames {
+		if _, ok := c.watching[username]; !ok {
+			added++
+		}
+	}
+	over := len(c.watching)+added > maxPresenceWatch
+	c.mu.Unlock()
+	if over {
+		return errPresenceWatch
+	}
+
+	mates, err := c.hub.mates(ctx, c.username, data.Usernames)
+	if err != nil {
+		return err
+	}
+	if !allMates(data.Usernames, mates) {
+		return errPresenceMates
+	}
+	c.mu.Lock()
+	if c.watching == nil {
+		c.watching = make(map[string]struct{})
+	}
+	for _, username := range data.Usernames {
+		c.watching[username] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	list, err := c.hub.presence(ctx, data.Usernames, mates)
+	if err != nil {
+		return err
+	}
+	for _, p := range list {
+		c.pushKeyed(presenceKey(p.Username), "presence", p)
+	}
+	return nil
+}
+
+// handlePresenceUnwatch stops watching the users
+func handlePresenceUnwatch(ctx context.Context, c *client, m *message) error {
+	var data presenceWatchData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, username := range data.Usernames {
+		delete(c.watching, username)
+	}
+	return nil
+}
+
+// get the presence of the guild mates, like ?users=aspirin2d,ibuprofen
+func getPresenceHandler(h *hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var usernames []string
+		for _, u := range strings.Split(c.Query("users"), ",") {
+			if u = strings.TrimSpace(u); len(u) > 0 {
+				usernames = append(usernames, u)
+			}
+		}
+		if len(usernames) == 0 || len(usernames) > maxPresenceQuery {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"reason": "illigal users",
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*5)
+		defer cancel()
+
+		mates, err := h.mates(ctx, c.GetString("username"), usernames)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to find the mates")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !allMates(usernames, mates) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"reason": "not guild mates",
+			})
+			return
+		}
+		list, err := h.presence(ctx, usernames, mates)
+		if err != nil {
+			requestLog(c).WithError(err).Error("failed to query the presence")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
@@ -0,0 +1,207 @@
+package vanilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+// read the next presence message
+func readPresence(t *testing.T, conn *websocket.Conn) presenceData {
+	var env struct {
+		Type string
+		Data presenceData
+	}
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "presence", env.Type)
+	return env.Data
+}
+
+func TestPresence(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WS.PresenceTTL = time.Millisecond * 300
+	cfg.WS.AwayAfter = time.Millisecond * 500
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+
+	rb, _ := json.Marshal(map[string]string{
+		"username": "ibuprofen",
+		"email":    "ibuprofen@example.com",
+		"password": "Passw0rd!",
+	})
+	req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(rb))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// only the mates see the presence of each other
+	guild := func(username, id string) {
+		_, err := s.st.Players().Update(context.Background(), username, cause{Reason: "test"}, func(p *core.Player) error {
+			p.Guild = id
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	guild("aspirin2d", "knights")
+	guild("ibuprofen", "knights")
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws://" + s.Addr() + "/ws"
+	watcher, _, err := dialWS(websocket.DefaultDialer, url, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	readConnected(t, watcher, jsonCodec{})
+
+	watcher.WriteJSON(gin.H{"type": "presence.watch", "data": presenceWatchData{Usernames: []string{"ibuprofen"}}})
+	assert.Equal(t, presenceData{Username: "ibuprofen", Status: statusOffline}, readPresence(t, watcher))
+
+	friend, _ := s.tokens.issue("ibuprofen", time.Minute)
+	conn, _, err := dialWS(websocket.DefaultDialer, url, friend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := readPresence(t, watcher)
+	assert.Equal(t, statusOnline, p.Status)
+	assert.NotZero(t, p.LastSeen)
+
+	// set away, and back
+	conn.WriteJSON(gin.H{"type": "presence.status", "data": presenceStatusData{Status: statusAway}})
+	assert.Equal(t, statusAway, readPresence(t, watcher).Status)
+	conn.WriteJSON(gin.H{"type": "presence.status", "data": presenceStatusData{Status: statusOnline}})
+	assert.Equal(t, statusOnline, readPresence(t, watcher).Status)
+
+	// idle, then gone
+	assert.Equal(t, statusAway, readPresence(t, watcher).Status)
+	conn.Close()
+	p = readPresence(t, watcher)
+	assert.Equal(t, statusOffline, p.Status)
+
+	// the last seen is on the player, the watcher is idle too
+	req, _ = http.NewRequest("GET", "/api/presence?users=ibuprofen,aspirin2d", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list []presenceData
+	json.NewDecoder(w.Body).Decode(&list)
+	assert.Equal(t, []presenceData{
+		{Username: "ibuprofen", Status: statusOffline, LastSeen: p.LastSeen},
+		{Username: "aspirin2d", Status: statusAway},
+	}, list)
+
+	// not anymore, once out of the guild
+	guild("ibuprofen", "")
+	req, _ = http.NewRequest("GET", "/api/presence?users=ibuprofen", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	watcher.WriteJSON(gin.H{"type": "presence.watch", "data": presenceWatchData{Usernames: []string{"ibuprofen"}}})
+	var env struct {
+		Type string
+		Data wsError
+	}
+	assert.NoError(t, watcher.ReadJSON(&env))
+	assert.Equal(t, "error", env.Type)
+	assert.Equal(t, errPresenceMates.Error(), env.Data.Reason)
+
+	req, _ = http.NewRequest("GET", "/api/presence", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPresenceCoalesce(t *testing.T) {
+	h := newHub(DefaultWSConfig(), newMetrics(), trace.NewNoopTracerProvider().Tracer(""), nil, newMemoryBroker())
+	c := newTestClient(h)
+	c.watching = map[string]struct{}{"ibuprofen": {}, "paracetamol": {}}
+	h.clients[c] = struct{}{}
+
+	// the pending status of a user is replaced by the next one
+	for _, p := range []presenceData{
+		{Username: "ibuprofen", Status: statusOnline, LastSeen: 1},
+		{Username: "paracetamol", Status: statusOnline, LastSeen: 1},
+		{Username: "ibuprofen", Status: statusAway},
+	} {
+		payload, _ := json.Marshal(&p)
+		h.receivePresence(payload)
+	}
+
+	var got []presenceData
+	for _, o := range c.queue.take() {
+		var env struct{ Data presenceData }
+		json.Unmarshal(o.frame, &env)
+		got = append(got, env.Data)
+	}
+	assert.Equal(t, []presenceData{
+		{Username: "paracetamol", Status: statusOnline, LastSeen: 1},
+		{Username: "ibuprofen", Status: statusAway},
+	}, got)
+
+	payload, _ := json.Marshal(&presenceData{Username: "ibuprofen", Status: statusOffline, LastSeen: 2})
+	h.receivePresence(payload)
+	var env struct{ Data presenceData }
+	json.Unmarshal(c.queue.take()[0].frame, &env)
+	assert.Equal(t, int64(2), env.Data.LastSeen)
+}
+
+// a broker whose joins of the user wait until released
+type slowJoinBroker struct {
+	broker
+	username string
+	release  chan struct{}
+}
+
+func (b *slowJoinBroker) Join(ctx context.Context, username, node, status string, ttl time.Duration) error {
+	if username == b.username {
+		<-b.release
+	}
+	return b.broker.Join(ctx, username, node, status, ttl)
+}
+
+func TestPresenceRefreshConcurrent(t *testing.T) {
+	b := &slowJoinBroker{broker: newMemoryBroker(), username: "ibuprofen", release: make(chan struct{})}
+	h := newHub(DefaultWSConfig(), newMetrics(), trace.NewNoopTracerProvider().Tracer(""), nil, b)
+	for _, username := range []string{"ibuprofen", "aspirin2d"} {
+		h.clients[&client{username: username, lastActive: time.Now()}] = struct{}{}
+	}
+
+	// the refreshes don't wait for the broker
+	h.refresh("ibuprofen")
+	h.refresh("ibuprofen")
+	h.refresh("aspirin2d")
+
+	// the others don't wait for the slow broker either
+	assert.Eventually(t, func() bool {
+		nodes, _ := b.Nodes(context.Background(), "aspirin2d")
+		return nodes[h.node] == statusOnline
+	}, time.Second, time.Millisecond*10, "refresh blocked by another user")
+
+	close(b.release)
+	h.waitRefreshes()
+	nodes, _ := b.Nodes(context.Background(), "ibuprofen")
+	assert.Equal(t, map[string]string{h.node: statusOnline}, nodes)
+	h.presenceMu.Lock()
+	assert.Empty(t, h.refreshing)
+	h.presenceMu.Unlock()
+}
@@ -2,78 +2,335 @@ package vanilla
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 var (
-	server *http.Server
+	// Start is called twice
+	errStarted = errors.New("server already started")
+	// Shutdown is called
+	errShuttingDown = errors.New("server is shutting down")
 )
 
-type user struct {
-	name string
+// Server of the game, create it with New
+type Server struct {
+	cfg      Config
+	st       storage
+	hub      *hub
+	chat     *chat
+	sync     *playerSync
+	notifier *notifier
+	tokens   *tokens
+	tickets  *tickets
+	tables   map[string]*table
+	metrics  *metrics
+	log      *logrus.Logger
+	tp       *sdktrace.TracerProvider
+	// set when Shutdown begins
+	shuttingDown int32
+
+	router   *gin.Engine
+	http     *http.Server
+	listener net.Listener
+	certs    *certReloader
+	// the plain http server which redirects to https
+	redirect         *http.Server
+	redirectListener net.Listener
+
+	// the serving error, if it stopped before Shutdown
+	errc chan error
+	once sync.Once
 }
 
-func setupRouter() (*gin.Engine, error) {
-	db, err := initDB("mongodb://localhost:27017")
+// New server of the config, nothing is connected or listened until Start
+func New(cfg Config) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	logger, err := NewLogger(cfg.LogLevel, cfg.LogFormat, os.Stderr)
 	if err != nil {
 		return nil, err
 	}
 
-	router := gin.Default()
-	router.Use(CORSMiddleware())
+	tp, err := newTracerProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	router.POST("/login", getLoginHandler(db))
-	router.POST("/register", getRegisterHandler(db))
+	// nothing is connected until Start
+	b, err := newBroker(cfg.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
 
-	api := router.Group("/api")
-	api.Use(authMiddleware())
-	api.GET("/ping", getPingHandler())
-	api.GET("/playerinfo", getPlayerInfoHandler(db))
+	m := newMetrics()
+	tokens := newTokens(cfg.JWTKey, cfg.TokenExpire)
+	return &Server{
+		cfg:     cfg,
+		hub:     newHub(cfg.WS, m, tp.Tracer(tracerName), tokens, b),
+		tokens:  tokens,
+		tickets: newTickets(),
+		metrics: m,
+		log:     logger,
+		tp:      tp,
+		errc:    make(chan error, 1),
+	}, nil
+}
 
-	ws := router.Group("/ws")
-	ws.GET("", getWSHandler(db))
+// Start connects to the mongodb, migrates it, and starts serving on the address of the config,
+// it returns after the server is listening
+func (s *Server) Start(ctx context.Context) (err error) {
+	if s.listener != nil {
+		return errStarted
+	}
 
-	return router, nil
-}
+	if len(s.cfg.TablesFile) > 0 {
+		tables, err := loadTables(s.cfg.TablesFile)
+		if err != nil {
+			return err
+		}
+		s.tables = tables
+	}
+
+	// the storage may be set already by the tests
+	if s.st == nil {
+		db, err := initDB(ctx, s.cfg.MongoURI,
+			joinMonitors(s.metrics.mongoMonitor(), newMongoTracer(s.tp.Tracer(tracerName)).monitor()), s.log)
+		if err != nil {
+			return err
+		}
+		s.log.Info("connected to mongodb")
+		s.st = newMongoStorage(db)
+	}
+	s.st = newTracedStorage(s.st, s.tp.Tracer(tracerName))
+	// every change of the players is pushed to their connections
+	s.sync = newPlayerSync(s.hub)
+	// and the players are told of the resources granted
+	s.notifier = newNotifier(s.hub, s.st.Notifications(), s.log)
+	s.st = newObservedStorage(s.st, s.sync.changed, s.notifier.added)
+
+	// stop everything started, if it fails to start
+	defer func() {
+		if err != nil {
+			s.hub.stopOnce.Do(func() { close(s.hub.stop) })
+			s.hub.broker.Close()
+			s.st.Close(ctx)
+		}
+	}()
+
+	if err := s.hub.start(ctx, s.st.Players()); err != nil {
+		return err
+	}
+	if err := s.sync.start(ctx, s.st.Players()); err != nil {
+		return err
+	}
+	s.chat = newChat(s.cfg.Chat, s.hub, s.st.Chat(), s.st.Players())
+	if err := s.chat.start(ctx); err != nil {
+		return err
+	}
+
+	s.router = s.setupRouter()
+	s.http = &http.Server{Handler: s.router}
+
+	tlsEnabled := len(s.cfg.TLSCertFile) > 0
+	if tlsEnabled {
+		certs, err := newCertReloader(s.cfg.TLSCertFile, s.cfg.TLSKeyFile, s.log)
+		if err != nil {
+			return err
+		}
+		s.certs = certs
+		s.http.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		if s.cfg.DisableHTTP2 {
+			// a non-nil map turns off the automatic HTTP/2
+			s.http.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
 
-// Run the server
-func Run(addr string) {
-	router, err := setupRouter()
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", s.cfg.Addr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	server = &http.Server{
-		Addr:    addr,
-		Handler: router,
+	if len(s.cfg.RedirectAddr) > 0 {
+		if s.redirectListener, err = lc.Listen(ctx, "tcp", s.cfg.RedirectAddr); err != nil {
+			listener.Close()
+			return err
+		}
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		s.redirect = &http.Server{Handler: getRedirectHandler(port)}
+
+		go func() {
+			if err := s.redirect.Serve(s.redirectListener); err != nil && err != http.ErrServerClosed {
+				s.log.WithError(err).Error("redirect server error")
+			}
+		}()
 	}
 
+	s.listener = listener
+
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("gin server error: %s", err)
+		var err error
+		if tlsEnabled {
+			// the certificate comes from the TLSConfig
+			err = s.http.ServeTLS(listener, "", "")
+		} else {
+			err = s.http.Serve(listener)
 		}
+		if err != nil && err != http.ErrServerClosed {
+			s.errc <- err
+		}
+		close(s.errc)
 	}()
+	return nil
 }
 
-// Stop the server
-func Stop() {
-	if server != nil {
-		log.Println("Shutdown Server ...")
+// Addr the server is listening on, empty before Start
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			log.Fatal("Server Shutdown:", err)
-		}
-		// catching ctx.Done(). timeout of 1 seconds.
+// Err receives the error which stopped the server before Shutdown, closed after the server stopped
+func (s *Server) Err() <-chan error {
+	return s.errc
+}
+
+// Shutdown the server gracefully before the ctx is done: stop accepting connections,
+// close the websocket clients after their pending messages are sent,
+// wait for the in-flight game actions, then disconnect the broker and the mongodb
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return nil
+	}
+
+	var err error
+	s.once.Do(func() {
+		// turn unavailable first, and give the load balancer some time to notice
+		atomic.StoreInt32(&s.shuttingDown, 1)
 		select {
+		case <-time.After(s.cfg.ShutdownDelay):
 		case <-ctx.Done():
-			log.Println("timeout of 1 second.")
 		}
-		log.Println("Server exiting")
+
+		s.log.Info("shutting down the server")
+		if s.redirect != nil {
+			s.redirect.Shutdown(ctx)
+		}
+		if e := s.http.Shutdown(ctx); e != nil {
+			err = e
+		}
+
+		if e := s.hub.shutdown(ctx, websocket.CloseServiceRestart, "server restarting"); e != nil && err == nil {
+			err = e
+		}
+
+		// disconnect anyway, even if the deadline is exceeded
+		if ctx.Err() != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.Background(), closeGracePeriod)
+			defer cancel()
+		}
+		if e := s.hub.broker.Close(); e != nil && err == nil {
+			err = e
+		}
+		if e := s.st.Close(ctx); e != nil && err == nil {
+			err = e
+		}
+		// flush the pending spans
+		if e := s.tp.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+		s.log.Info("server exited")
+	})
+	return err
+}
+
+func (s *Server) setupRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(logMiddleware(s.log))
+	router.Use(traceMiddleware(s.tp.Tracer(tracerName)))
+	router.Use(gin.RecoveryWithWriter(s.log.WriterLevel(logrus.ErrorLevel)))
+	router.Use(s.metrics.middleware())
+	router.Use(CORSMiddleware(s.cfg.CORS))
+
+	users, players := s.st.Users(), s.st.Players()
+
+	router.GET("/healthz", getHealthHandler())
+	router.GET("/readyz", getReadyHandler(s.checks()))
+	router.GET("/metrics", s.metrics.handler())
+
+	router.POST("/login", getLoginHandler(users, s.tokens, s.metrics))
+	router.POST("/register", getRegisterHandler(users, s.tokens, s.metrics))
+
+	api := router.Group("/api")
+	api.Use(authMiddleware(s.tokens))
+	api.GET("/ping", getPingHandler())
+	api.POST("/logout", getLogoutHandler(s.hub))
+	api.POST("/ws/ticket", getTicketHandler(s.tickets))
+	api.GET("/me", getMeHandler(players))
+	// the old clients poll it, the username query is ignored
+	api.GET("/playerinfo", deprecated("/api/me"), getMeHandler(players))
+	api.PATCH("/me", getUpdateMeHandler(players))
+	api.GET("/me/ledger", getLedgerHandler(s.st.Ledger()))
+	notes := s.st.Notifications()
+	api.GET("/me/notifications", getNotificationsHandler(notes))
+	api.POST("/me/notifications/read", getMarkReadHandler(notes))
+	api.DELETE("/me/notifications/:id", getDeleteNotificationHandler(notes))
+	api.GET("/me/notification-prefs", getNotificationPrefsHandler(notes))
+	api.PUT("/me/notification-prefs", getUpdateNotificationPrefsHandler(notes))
+	api.GET("/players/:name", getPlayerHandler(players))
+	api.GET("/presence", getPresenceHandler(s.hub))
+	api.GET("/chat/:channel/messages", getChatHistoryHandler(s.chat))
+	api.DELETE("/chat/messages/:id", getChatDeleteHandler(s.chat))
+
+	ws := router.Group("/ws")
+	// validated by New
+	origins, _ := newOrigins(s.cfg.CORS.AllowOrigins)
+	ws.GET("", getWSHandler(s.hub, s.tokens, s.tickets, origins))
+
+	return router
+}
+
+// the readiness checks of the components
+func (s *Server) checks() []check {
+	return []check{
+		{"mongo", s.st.Ping},
+		{"hub", func(ctx context.Context) error {
+			return s.hub.running()
+		}},
+		{"server", func(ctx context.Context) error {
+			if atomic.LoadInt32(&s.shuttingDown) == 1 {
+				return errShuttingDown
+			}
+			return nil
+		}},
+		{"tables", func(ctx context.Context) error {
+			if len(s.cfg.TablesFile) == 0 {
+				return errNotConfigured
+			}
+			if len(s.tables) == 0 {
+				return errNoTables
+			}
+			return nil
+		}},
 	}
 }
@@ -0,0 +1,260 @@
+package vanilla
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// the close code of the connection whose session is resumed by another one
+	closeSessionTaken = 4005
+)
+
+// session outlives the connections, so a client reconnecting in time gets the messages it missed,
+// every message pushed to the session is numbered, and kept until the client acks it
+type session struct {
+	id       string
+	username string
+	hub      *hub
+
+	mu     sync.Mutex
+	seq    uint64
+	buffer []sentMessage
+	// the connection attached, nil while disconnected
+	client *client
+	// drops the session when it's disconnected for too long
+	expiry *time.Timer
+}
+
+// a message kept for the replay, encoded again for the codec of the resuming connection
+type sentMessage struct {
+	seq  uint64
+	typ  string
+	data interface{}
+}
+
+// the session message, the first one of every connection, not numbered itself
+type sessionData struct {
+	ID string `json:"id"`
+	// the missed messages follow, otherwise the client must fetch the whole state again
+	Resumed bool `json:"resumed"`
+	// the last seq of the session
+	Seq uint64 `json:"seq"`
+}
+
+// the ack message of the client, every message up to the seq is received
+type ackData struct {
+	Seq uint64 `json:"seq"`
+}
+
+// the resume request of the upgrade: ?session=<id>&seq=<last seq received>
+type resumeRequest struct {
+	id  string
+	seq uint64
+}
+
+func parseResume(id, seq string) *resumeRequest {
+	if len(id) == 0 {
+		return nil
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &resumeRequest{id: id, seq: n}
+}
+
+// send the message of the type to the client attached, numbered and kept until acked,
+// while detached it's only kept, and replayed when the session is resumed,
+// under the lock of the session, so the order of the seq is the order of the queue
+func (s *session) send(key, typ string, data interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	s.buffer = append(s.buffer, sentMessage{seq: s.seq, typ: typ, data: data})
+	if over := len(s.buffer) - s.hub.cfg.ResumeBuffer; over > 0 {
+		s.buffer = s.buffer[over:]
+	}
+
+	c := s.client
+	if c == nil {
+		return nil
+	}
+	frame, err := c.codec.encode(s.seq, typ, data)
+	if err != nil {
+		return err
+	}
+	if !c.enqueue(key, frame) {
+		return errSendQueueFull
+	}
+	s.hub.metrics.wsMessages.WithLabelValues("out", typ).Inc()
+	return nil
+}
+
+// ack the messages up to the seq, they won't be replayed
+func (s *session) ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := 0
+	for i < len(s.buffer) && s.buffer[i].seq <= seq {
+		i++
+	}
+	s.buffer = s.buffer[i:]
+}
+
+// attach the client, and replay the messages after the seq if they're all kept,
+// reports whether they are, otherwise the client must resync
+func (s *session) attach(c *client, seq uint64, resume bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.client != nil && s.client != c {
+		s.client.close(closeSessionTaken, "session resumed elsewhere")
+	}
+	s.client = c
+
+	// the first kept one must follow the seq right away, and the seq can't be from the future
+	resumed := resume && seq <= s.seq && (len(s.buffer) == 0 && seq == s.seq || len(s.buffer) > 0 && s.buffer[0].seq <= seq+1)
+	if !resumed {
+		s.buffer = nil
+	}
+
+	if err := c.pushUnsequenced("session", &sessionData{ID: s.id, Resumed: resumed, Seq: s.seq}); err != nil {
+		return false, err
+	}
+	if resumed {
+		for _, m := range s.buffer {
+			if m.seq <= seq {
+				continue
+			}
+			frame, err := c.codec.encode(m.seq, m.typ, m.data)
+			if err != nil {
+				return false, err
+			}
+			if !c.enqueue("", frame) {
+				return false, errSendQueueFull
+			}
+		}
+	}
+	return resumed, nil
+}
+
+// detach the client, if it's still the one attached, and drop the session after the ttl
+func (s *session) detach(c *client, ttl time.Duration, drop func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != c {
+		return
+	}
+	s.client = nil
+	s.expiry = time.AfterFunc(ttl, drop)
+}
+
+// resume the session of the request for the client, or start a new one,
+// under the lock of the hub, so a session is never dropped while it's resumed
+func (h *hub) resume(c *client, r *resumeRequest) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var (
+		s   *session
+		ok  bool
+		seq uint64
+	)
+	if r != nil {
+		// the sessions of the others are not found
+		if s, ok = h.sessions[r.id]; ok && s.username != c.username {
+			s, ok = nil, false
+		}
+		seq = r.seq
+	}
+	if !ok {
+		s = &session{id: newID() + newID(), username: c.username, hub: h}
+		h.sessions[s.id] = s
+		if h.userSessions[s.username] == nil {
+			h.userSessions[s.username] = make(map[*session]struct{})
+		}
+		h.userSessions[s.username][s] = struct{}{}
+	}
+
+	c.session = s
+	return s.attach(c, seq, ok)
+}
+
+// detach the client from its session, which can be resumed until the ResumeTimeout,
+// the messages to the user are kept in it meanwhile
+func (h *hub) detach(c *client) {
+	s := c.session
+	if s == nil {
+		return
+	}
+	s.detach(c, h.cfg.ResumeTimeout, func() {
+		if h.drop(s) {
+			// no longer reachable here, if it was the last one
+			h.refresh(s.username)
+		}
+	})
+}
+
+// drop the session, unless it's resumed in the meantime
+func (h *hub) drop(s *session) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return false
+	}
+	delete(h.sessions, s.id)
+	delete(h.userSessions[s.username], s)
+	if len(h.userSessions[s.username]) == 0 {
+		delete(h.userSessions, s.username)
+	}
+	return true
+}
+
+// the sessions of the user on this node, attached or detached, or all of them if the username is empty
+func (h *hub) sessionsOf(username string) []*session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var sessions []*session
+	if len(username) == 0 {
+		for _, s := range h.sessions {
+			sessions = append(sessions, s)
+		}
+		return sessions
+	}
+	for s := range h.userSessions[username] {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// deliver the message to the sessions of the user on this node, or of everyone if the username is empty,
+// the detached ones keep it until they're resumed or dropped
+func (h *hub) deliver(username, typ string, data interface{}) {
+	for _, s := range h.sessionsOf(username) {
+		s.send("", typ, data)
+	}
+}
+
+// handleAck trims the replay buffer of the session
+func handleAck(ctx context.Context, c *client, m *message) error {
+	var data ackData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errMalformedMessage
+	}
+	c.session.ack(data.Seq)
+	return nil
+}
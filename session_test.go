@@ -0,0 +1,181 @@
+package vanilla
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// read the session message, the first one of every connection
+func readSession(t *testing.T, conn *websocket.Conn, cd codec) sessionData {
+	var data sessionData
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := cd.decode(frame)
+	if err != nil || m.Type != "session" {
+		t.Fatal("session message expected")
+	}
+	cd.unmarshal(m.Data, &data)
+	return data
+}
+
+// read the session message, and the player snapshot following it on a new session
+func readConnected(t *testing.T, conn *websocket.Conn, cd codec) sessionData {
+	data := readSession(t, conn, cd)
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := cd.decode(frame)
+	if err != nil || m.Type != "player" {
+		t.Fatal("player snapshot expected")
+	}
+	return data
+}
+
+// the client attached to the session, once it's attached
+func attachedClient(h *hub, id string) *client {
+	for {
+		h.mu.Lock()
+		s := h.sessions[id]
+		h.mu.Unlock()
+
+		if s != nil {
+			s.mu.Lock()
+			c := s.client
+			s.mu.Unlock()
+			if c != nil {
+				return c
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws://" + s.Addr() + "/ws"
+
+	conn, _, err := dialWS(websocket.DefaultDialer, url, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the player snapshot is the 1st
+	sd := readConnected(t, conn, jsonCodec{})
+	assert.False(t, sd.Resumed)
+	assert.Equal(t, uint64(0), sd.Seq)
+
+	c := attachedClient(s.hub, sd.ID)
+	for i := 0; i < 3; i++ {
+		c.push("note", gin.H{"n": i})
+	}
+	for i := 2; i <= 4; i++ {
+		var env envelope
+		assert.NoError(t, conn.ReadJSON(&env))
+		assert.Equal(t, uint64(i), env.Seq)
+	}
+	conn.WriteJSON(gin.H{"type": "ack", "data": ackData{Seq: 2}})
+	time.Sleep(time.Millisecond * 50)
+	conn.Close()
+
+	// resumed after the 3rd, the 4th is replayed, then a new snapshot
+	resume := func(seq int) *websocket.Conn {
+		conn, _, err := dialWS(websocket.DefaultDialer, fmt.Sprintf("%s?session=%s&seq=%d", url, sd.ID, seq), token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	conn = resume(3)
+	defer conn.Close()
+	rd := readSession(t, conn, jsonCodec{})
+	assert.Equal(t, sessionData{ID: sd.ID, Resumed: true, Seq: 4}, rd)
+	var env struct {
+		Seq  uint64
+		Type string
+		Data json.RawMessage
+	}
+	assert.NoError(t, conn.ReadJSON(&env))
+	assert.Equal(t, uint64(4), env.Seq)
+	assert.JSONEq(t, `{"n": 2}`, string(env.Data))
+	assert.NoError(t, conn.ReadJSON(&env))
+	assert.Equal(t, uint64(5), env.Seq)
+	assert.Equal(t, "player", env.Type)
+
+	// taken over by the next connection, which has missed the acked one, so it must resync
+	next := resume(0)
+	defer next.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeSessionTaken))
+	rd = readConnected(t, next, jsonCodec{})
+	assert.Equal(t, sessionData{ID: sd.ID, Resumed: false, Seq: 5}, rd)
+
+	// the sequence goes on after the snapshot
+	attachedClient(s.hub, sd.ID).push("note", nil)
+	assert.NoError(t, next.ReadJSON(&env))
+	assert.Equal(t, uint64(7), env.Seq)
+
+	// unknown sessions start over
+	other, _, err := dialWS(websocket.DefaultDialer, url+"?session=nope&seq=3", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	rd = readSession(t, other, jsonCodec{})
+	assert.NotEqual(t, sd.ID, rd.ID)
+	assert.False(t, rd.Resumed)
+}
+
+func TestSessionDetached(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws://" + s.Addr() + "/ws"
+
+	conn, _, err := dialWS(websocket.DefaultDialer, url, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := readConnected(t, conn, jsonCodec{})
+	c := attachedClient(s.hub, sd.ID)
+	conn.Close()
+	<-c.done
+
+	// kept while disconnected, and offline to the others
+	assert.NoError(t, s.hub.sendTo(context.Background(), "aspirin2d", "note", gin.H{"n": 1}))
+	s.hub.waitRefreshes()
+	list, err := s.hub.presence(context.Background(), []string{"aspirin2d"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, statusOffline, list[0].Status)
+
+	conn, _, err = dialWS(websocket.DefaultDialer, fmt.Sprintf("%s?session=%s&seq=1", url, sd.ID), token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := readSession(t, conn, jsonCodec{})
+	assert.Equal(t, sessionData{ID: sd.ID, Resumed: true, Seq: 2}, rd)
+	var env envelope
+	assert.NoError(t, conn.ReadJSON(&env))
+	assert.Equal(t, uint64(2), env.Seq)
+	assert.Equal(t, "note", env.Type)
+	assert.Equal(t, map[string]interface{}{"n": float64(1)}, env.Data)
+}
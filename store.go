@@ -0,0 +1,171 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+var (
+	// record not found
+	errNotFound = errors.New("not found")
+	// username already registered
+	errUsernameTaken = errors.New("username taken")
+	// email already registered
+	errEmailTaken = errors.New("email taken")
+	// the player kept changing while being updated
+	errUpdateConflict = errors.New("update conflict")
+	// not enough resources to spend
+	errInsufficientResources = errors.New("insufficient resources")
+)
+
+// account is the credentials of a user, stored in the users collection
+type account struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Username string             `bson:"username"`
+	Email    string             `bson:"email"`
+	// bcrypt hash of the password
+	Password string `bson:"password"`
+}
+
+// storage is the storage layer of the game
+type storage interface {
+	Users() userStore
+	Players() playerStore
+	Ledger() ledgerStore
+	Chat() chatStore
+	Notifications() notificationStore
+	// run the fn in a transaction, so every store call in it with the given ctx is all or nothing,
+	// the fn is called again if the transaction failed on a transient error, so it must be idempotent,
+	// a nested call joins the outer transaction
+	WithTx(ctx context.Context, fn func(ctx context.Context) error) error
+	// check the connection
+	Ping(ctx context.Context) error
+	// release the connections
+	Close(ctx context.Context) error
+}
+
+// the ctx key which marks a running transaction
+type txKey struct{}
+
+// userStore keeps the credentials of the users
+type userStore interface {
+	// find the account by username
+	Find(ctx context.Context, username string) (*account, error)
+	// create the account and its player data in one transaction
+	Create(ctx context.Context, acc *account, player *core.Player) error
+}
+
+// playerStore keeps the game state of the players,
+// it never reads or writes the users collection, so the password hashes stay out of it
+type playerStore interface {
+	// find the player by username
+	Find(ctx context.Context, username string) (*core.Player, error)
+	// the players of the guild among the usernames, in one query, the others are left out
+	GuildMates(ctx context.Context, guild string, usernames []string) ([]*core.Player, error)
+	// set the profile fields, and return the updated player
+	UpdateProfile(ctx context.Context, username string, p *profile) (*core.Player, error)
+	// apply the fn to the latest player and save it, only if no one else changed the player meanwhile,
+	// otherwise reload and try again, so the fn may be called more than once,
+	// the change of the resources goes to the ledger with the cause
+	Update(ctx context.Context, username string, cause cause, fn func(p *core.Player) error) (*core.Player, error)
+	// add the delta to the resources atomically and record it in the ledger, then return the updated player,
+	// fails with errInsufficientResources if any resource would go below zero
+	AddResources(ctx context.Context, username string, delta core.Resources, cause cause) (*core.Player, error)
+	// overwrite the resources with the balances rebuilt from the ledger, without a new entry,
+	// only the ledger replay should call it
+	RestoreResources(ctx context.Context, username string, balances core.Resources) (*core.Player, error)
+	// set the last seen in unix seconds, the version is not bumped, it's not a change of the game state
+	SetLastSeen(ctx context.Context, username string, t int64) error
+}
+
+// cause of a resource change, recorded in the ledger
+type cause struct {
+	// why the resources changed, e.g. "build" or "admin_grant"
+	Reason string
+	// the action which made the change, e.g. "ws:build"
+	Source string
+}
+
+// entry of the change for the ledger
+func (c cause) entry(p *core.Player, delta core.Resources) *core.LedgerEntry {
+	return &core.LedgerEntry{
+		ID:       primitive.NewObjectID(),
+		Username: p.Username,
+		Delta:    delta,
+		Reason:   c.Reason,
+		Source:   c.Source,
+		Version:  p.Version,
+		Time:     time.Now(),
+	}
+}
+
+// ledgerStore keeps the append-only resource ledger, the entries are written by the playerStore
+type ledgerStore interface {
+	// the entries of the player matching the query, newest first
+	List(ctx context.Context, username string, q ledgerQuery) ([]*core.LedgerEntry, error)
+	// every entry of the player, oldest first
+	All(ctx context.Context, username string) ([]*core.LedgerEntry, error)
+}
+
+// ledgerQuery filters the ledger entries, zero fields match everything
+type ledgerQuery struct {
+	// only the entries older than this version
+	Before int64
+	Reason string
+	Limit  int64
+}
+
+// chatStore keeps the chat history, and the mute and block lists of the users
+type chatStore interface {
+	// save the new message
+	Save(ctx context.Context, m *core.ChatMessage) error
+	// the messages of the channel older than the before id, or the latest if it's zero, newest first,
+	// the deleted ones are left out
+	History(ctx context.Context, channel string, before primitive.ObjectID, limit int64) ([]*core.ChatMessage, error)
+	// mark the message deleted by the moderator, and return it
+	Delete(ctx context.Context, id primitive.ObjectID, moderator string) (*core.ChatMessage, error)
+	// the lists of the user, empty if never set
+	Lists(ctx context.Context, username string) (*core.ChatLists, error)
+	// add the target to the list of the user, or remove it, the list is "muted" or "blocked"
+	SetListed(ctx context.Context, username, list, target string, listed bool) (*core.ChatLists, error)
+}
+
+// notificationStore keeps the inboxes of the players, and their preferences
+type notificationStore interface {
+	// add the notification to the inbox
+	Add(ctx context.Context, n *core.Notification) error
+	// the notifications of the player matching the query, newest first
+	List(ctx context.Context, username string, q notificationQuery) ([]*core.Notification, error)
+	// mark the notifications of the ids read, or all of them if none, and return how many are changed
+	MarkRead(ctx context.Context, username string, ids []primitive.ObjectID) (int64, error)
+	// delete the notification of the player
+	Delete(ctx context.Context, username string, id primitive.ObjectID) error
+	// the preferences of the player, empty if never set
+	Prefs(ctx context.Context, username string) (*core.NotificationPrefs, error)
+	// set the preferences of the categories, the others are left untouched
+	SetPrefs(ctx context.Context, username string, prefs map[string]core.NotificationPref) (*core.NotificationPrefs, error)
+}
+
+// notificationQuery filters the notifications, zero fields match everything
+type notificationQuery struct {
+	// only the ones older than this id
+	Before primitive.ObjectID
+	Unread bool
+	Limit  int64
+}
+
+const (
+	// max attempts of a compare-and-swap update
+	maxUpdateRetries = 5
+	// max entries of a ledger query
+	maxLedgerLimit = 100
+	// max messages of a chat history query
+	maxChatLimit = 100
+	// max notifications of a query
+	maxNotificationLimit = 100
+)
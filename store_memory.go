@@ -0,0 +1,499 @@
+package vanilla
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+// memoryStorage keeps everything in memory, for tests and local development,
+// a transaction holds the lock until it's done, so transactions are serialized
+type memoryStorage struct {
+	mu      sync.Mutex
+	users   map[string]*account
+	players map[string]*core.Player
+	ledger  []*core.LedgerEntry
+	// the chat is not transactional
+	chat      []*core.ChatMessage
+	chatLists map[string]*core.ChatLists
+	// the notifications are not transactional either
+	notifications     []*core.Notification
+	notificationPrefs map[string]*core.NotificationPrefs
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		users:     make(map[string]*account),
+		players:   make(map[string]*core.Player),
+		chatLists: make(map[string]*core.ChatLists),
+
+		notificationPrefs: make(map[string]*core.NotificationPrefs),
+	}
+}
+
+func (s *memoryStorage) Users() userStore {
+	return (*memoryUserStore)(s)
+}
+
+func (s *memoryStorage) Players() playerStore {
+	return (*memoryPlayerStore)(s)
+}
+
+func (s *memoryStorage) Ledger() ledgerStore {
+	return (*memoryLedgerStore)(s)
+}
+
+func (s *memoryStorage) Chat() chatStore {
+	return (*memoryChatStore)(s)
+}
+
+func (s *memoryStorage) Notifications() notificationStore {
+	return (*memoryNotificationStore)(s)
+}
+
+func (s *memoryStorage) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.inTx(ctx) {
+		return fn(ctx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// roll back to the snapshot if the fn failed, the ledger is append-only
+	users, players, entries := s.snapshot()
+	if err := fn(context.WithValue(ctx, txKey{}, s)); err != nil {
+		s.users, s.players, s.ledger = users, players, s.ledger[:entries]
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStorage) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStorage) inTx(ctx context.Context) bool {
+	return ctx.Value(txKey{}) == s
+}
+
+// lock the storage, unless the ctx is in a transaction which already holds the lock
+func (s *memoryStorage) lock(ctx context.Context) func() {
+	if s.inTx(ctx) {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+func (s *memoryStorage) snapshot() (map[string]*account, map[string]*core.Player, int) {
+	users := make(map[string]*account, len(s.users))
+	for k, v := range s.users {
+		acc := *v
+		users[k] = &acc
+	}
+	players := make(map[string]*core.Player, len(s.players))
+	for k, v := range s.players {
+		players[k] = clonePlayer(v)
+	}
+	return users, players, len(s.ledger)
+}
+
+// deep copy of the player, so the callers never share the stored one
+func clonePlayer(p *core.Player) *core.Player {
+	data, err := bson.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	clone := &core.Player{}
+	if err := bson.Unmarshal(data, clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
+type memoryUserStore memoryStorage
+
+func (s *memoryUserStore) Find(ctx context.Context, username string) (*account, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	acc, ok := s.users[username]
+	if !ok {
+		return nil, errNotFound
+	}
+	clone := *acc
+	return &clone, nil
+}
+
+func (s *memoryUserStore) Create(ctx context.Context, acc *account, player *core.Player) error {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	if _, ok := s.users[acc.Username]; ok {
+		return errUsernameTaken
+	}
+	if _, ok := s.players[player.Username]; ok {
+		return errUsernameTaken
+	}
+	for _, u := range s.users {
+		if u.Email == acc.Email {
+			return errEmailTaken
+		}
+	}
+
+	clone := *acc
+	s.users[acc.Username] = &clone
+	s.players[player.Username] = clonePlayer(player)
+	return nil
+}
+
+type memoryPlayerStore memoryStorage
+
+func (s *memoryPlayerStore) Find(ctx context.Context, username string) (*core.Player, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	player, ok := s.players[username]
+	if !ok {
+		return nil, errNotFound
+	}
+	return clonePlayer(player), nil
+}
+
+func (s *memoryPlayerStore) GuildMates(ctx context.Context, guild string, usernames []string) ([]*core.Player, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	var players []*core.Player
+	for _, username := range usernames {
+		if player, ok := s.players[username]; ok && player.Guild == guild {
+			players = append(players, clonePlayer(player))
+		}
+	}
+	return players, nil
+}
+
+func (s *memoryPlayerStore) UpdateProfile(ctx context.Context, username string, p *profile) (*core.Player, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	player, ok := s.players[username]
+	if !ok {
+		return nil, errNotFound
+	}
+	if p.DisplayName != nil {
+		player.DisplayName = *p.DisplayName
+	}
+	if p.Avatar != nil {
+		player.Avatar = *p.Avatar
+	}
+	if p.Bio != nil {
+		player.Bio = *p.Bio
+	}
+	player.Version++
+	return clonePlayer(player), nil
+}
+
+func (s *memoryPlayerStore) Update(ctx context.Context, username string, cause cause, fn func(p *core.Player) error) (*core.Player, error) {
+	for i := 0; i < maxUpdateRetries; i++ {
+		// the fn runs without the lock, just like it does with mongo
+		player, err := s.Find(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+
+		id, version, before := player.ID, player.Version, player.Resources()
+		if err := fn(player); err != nil {
+			return nil, err
+		}
+		player.ID, player.Username = id, username
+		player.Version = version + 1
+
+		if s.swap(ctx, player, version, cause, player.Resources().Sub(before)) {
+			return clonePlayer(player), nil
+		}
+	}
+	return nil, errUpdateConflict
+}
+
+// replace the stored player if its version is still the old one, and record the delta in the ledger
+func (s *memoryPlayerStore) swap(ctx context.Context, player *core.Player, version int64, cause cause, delta core.Resources) bool {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	old, ok := s.players[player.Username]
+	if !ok || old.Version != version {
+		return false
+	}
+	s.players[player.Username] = clonePlayer(player)
+	if !delta.IsZero() {
+		s.ledger = append(s.ledger, cause.entry(player, delta))
+	}
+	return true
+}
+
+func (s *memoryPlayerStore) AddResources(ctx context.Context, username string, delta core.Resources, cause cause) (*core.Player, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	player, ok := s.players[username]
+	if !ok {
+		return nil, errNotFound
+	}
+	// nothing changed, nothing to record
+	if delta.IsZero() {
+		return clonePlayer(player), nil
+	}
+	if !player.AddResources(delta) {
+		return nil, errInsufficientResources
+	}
+	player.Version++
+	s.ledger = append(s.ledger, cause.entry(player, delta))
+	return clonePlayer(player), nil
+}
+
+func (s *memoryPlayerStore) RestoreResources(ctx context.Context, username string, balances core.Resources) (*core.Player, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	player, ok := s.players[username]
+	if !ok {
+		return nil, errNotFound
+	}
+	player.SetResources(balances)
+	player.Version++
+	return clonePlayer(player), nil
+}
+
+func (s *memoryPlayerStore) SetLastSeen(ctx context.Context, username string, t int64) error {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	player, ok := s.players[username]
+	if !ok {
+		return errNotFound
+	}
+	player.LastSeen = t
+	return nil
+}
+
+type memoryLedgerStore memoryStorage
+
+func (s *memoryLedgerStore) List(ctx context.Context, username string, q ledgerQuery) ([]*core.LedgerEntry, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	if q.Limit <= 0 || q.Limit > maxLedgerLimit {
+		q.Limit = maxLedgerLimit
+	}
+
+	entries := []*core.LedgerEntry{}
+	for i := len(s.ledger) - 1; i >= 0 && int64(len(entries)) < q.Limit; i-- {
+		e := s.ledger[i]
+		if e.Username != username || (q.Before > 0 && e.Version >= q.Before) ||
+			(len(q.Reason) > 0 && e.Reason != q.Reason) {
+			continue
+		}
+		clone := *e
+		entries = append(entries, &clone)
+	}
+	return entries, nil
+}
+
+func (s *memoryLedgerStore) All(ctx context.Context, username string) ([]*core.LedgerEntry, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	entries := []*core.LedgerEntry{}
+	for _, e := range s.ledger {
+		if e.Username == username {
+			clone := *e
+			entries = append(entries, &clone)
+		}
+	}
+	return entries, nil
+}
+
+type memoryChatStore memoryStorage
+
+func (s *memoryChatStore) Save(ctx context.Context, m *core.ChatMessage) error {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	clone := *m
+	s.chat = append(s.chat, &clone)
+	return nil
+}
+
+func (s *memoryChatStore) History(ctx context.Context, channel string, before primitive.ObjectID, limit int64) ([]*core.ChatMessage, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	if limit <= 0 || limit > maxChatLimit {
+		limit = maxChatLimit
+	}
+
+	messages := []*core.ChatMessage{}
+	for i := len(s.chat) - 1; i >= 0 && int64(len(messages)) < limit; i-- {
+		m := s.chat[i]
+		if m.Channel != channel || m.Deleted || (!before.IsZero() && bytes.Compare(m.ID[:], before[:]) >= 0) {
+			continue
+		}
+		clone := *m
+		messages = append(messages, &clone)
+	}
+	return messages, nil
+}
+
+func (s *memoryChatStore) Delete(ctx context.Context, id primitive.ObjectID, moderator string) (*core.ChatMessage, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	for _, m := range s.chat {
+		if m.ID == id {
+			m.Deleted, m.DeletedBy = true, moderator
+			clone := *m
+			return &clone, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (s *memoryChatStore) Lists(ctx context.Context, username string) (*core.ChatLists, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	return s.lists(username), nil
+}
+
+func (s *memoryChatStore) SetListed(ctx context.Context, username, list, target string, listed bool) (*core.ChatLists, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	l, ok := s.chatLists[username]
+	if !ok {
+		l = &core.ChatLists{Username: username, Muted: []string{}, Blocked: []string{}}
+		s.chatLists[username] = l
+	}
+	targets := &l.Muted
+	if list == chatListBlocked {
+		targets = &l.Blocked
+	}
+
+	kept := []string{}
+	for _, t := range *targets {
+		if t != target {
+			kept = append(kept, t)
+		}
+	}
+	if listed {
+		kept = append(kept, target)
+	}
+	*targets = kept
+	return s.lists(username), nil
+}
+
+// a copy of the lists of the user
+func (s *memoryChatStore) lists(username string) *core.ChatLists {
+	l, ok := s.chatLists[username]
+	if !ok {
+		return &core.ChatLists{Username: username, Muted: []string{}, Blocked: []string{}}
+	}
+	return &core.ChatLists{
+		Username: username,
+		Muted:    append([]string{}, l.Muted...),
+		Blocked:  append([]string{}, l.Blocked...),
+	}
+}
+
+type memoryNotificationStore memoryStorage
+
+func (s *memoryNotificationStore) Add(ctx context.Context, n *core.Notification) error {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	clone := *n
+	s.notifications = append(s.notifications, &clone)
+	return nil
+}
+
+func (s *memoryNotificationStore) List(ctx context.Context, username string, q notificationQuery) ([]*core.Notification, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	if q.Limit <= 0 || q.Limit > maxNotificationLimit {
+		q.Limit = maxNotificationLimit
+	}
+
+	list := []*core.Notification{}
+	for i := len(s.notifications) - 1; i >= 0 && int64(len(list)) < q.Limit; i-- {
+		n := s.notifications[i]
+		if n.Username != username || (q.Unread && n.Read) ||
+			(!q.Before.IsZero() && bytes.Compare(n.ID[:], q.Before[:]) >= 0) {
+			continue
+		}
+		clone := *n
+		list = append(list, &clone)
+	}
+	return list, nil
+}
+
+func (s *memoryNotificationStore) MarkRead(ctx context.Context, username string, ids []primitive.ObjectID) (int64, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	var changed int64
+	for _, n := range s.notifications {
+		if n.Username != username || n.Read {
+			continue
+		}
+		if len(ids) > 0 && !containsID(ids, n.ID) {
+			continue
+		}
+		n.Read = true
+		changed++
+	}
+	return changed, nil
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryNotificationStore) Delete(ctx context.Context, username string, id primitive.ObjectID) error {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	for i, n := range s.notifications {
+		if n.ID == id && n.Username == username {
+			s.notifications = append(s.notifications[:i], s.notifications[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *memoryNotificationStore) Prefs(ctx context.Context, username string) (*core.NotificationPrefs, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	return s.prefs(username), nil
+}
+
+func (s *memoryNotificationStore) SetPrefs(ctx context.Context, username string, prefs map[string]core.NotificationPref) (*core.NotificationPrefs, error) {
+	defer (*memoryStorage)(s).lock(ctx)()
+
+	p, ok := s.notificationPrefs[username]
+	if !ok {
+		p = &core.NotificationPrefs{Username: username, Categories: make(map[string]core.NotificationPref)}
+		s.notificationPrefs[username] = p
+	}
+	for category, pref := range prefs {
+		p.Categories[category] = pref
+	}
+	return s.prefs(username), nil
+}
+
+// a copy of the preferences of the player
+func (s *memoryNotificationStore) prefs(username string) *core.NotificationPrefs {
+	clone := &core.NotificationPrefs{Username: username, Categories: make(map[string]core.NotificationPref)}
+	if p, ok := s.notificationPrefs[username]; ok {
+		for category, pref := range p.Categories {
+			clone.Categories[category] = pref
+		}
+	}
+	return clone
+}
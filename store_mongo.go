@@ -0,0 +1,553 @@
+package vanilla
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+type mongoStorage struct {
+	db      *mongo.Database
+	users   *mongoUserStore
+	players *mongoPlayerStore
+	ledger  *mongoLedgerStore
+	chat    *mongoChatStore
+	notes   *mongoNotificationStore
+}
+
+func newMongoStorage(db *mongo.Database) *mongoStorage {
+	s := &mongoStorage{db: db}
+	s.users = &mongoUserStore{s: s, col: db.Collection(UserCollection)}
+	s.players = &mongoPlayerStore{s: s, col: db.Collection(PlayerCollection)}
+	s.ledger = &mongoLedgerStore{col: db.Collection(LedgerCollection)}
+	s.chat = &mongoChatStore{col: db.Collection(ChatCollection), lists: db.Collection(ChatListCollection)}
+	s.notes = &mongoNotificationStore{col: db.Collection(NotificationCollection), prefs: db.Collection(NotificationPrefCollection)}
+	return s
+}
+
+func (s *mongoStorage) Users() userStore {
+	return s.users
+}
+
+func (s *mongoStorage) Players() playerStore {
+	return s.players
+}
+
+func (s *mongoStorage) Ledger() ledgerStore {
+	return s.ledger
+}
+
+func (s *mongoStorage) Chat() chatStore {
+	return s.chat
+}
+
+func (s *mongoStorage) Notifications() notificationStore {
+	return s.notes
+}
+
+// WithTx retries the whole transaction on TransientTransactionError,
+// and the commit on UnknownTransactionCommitResult, see mongo.Session.WithTransaction
+func (s *mongoStorage) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(txKey{}) != nil {
+		return fn(ctx)
+	}
+
+	return s.db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(context.WithValue(sc, txKey{}, s))
+		})
+		return err
+	})
+}
+
+func (s *mongoStorage) Ping(ctx context.Context) error {
+	return s.db.Client().Ping(ctx, readpref.Primary())
+}
+
+func (s *mongoStorage) Close(ctx context.Context) error {
+	return s.db.Client().Disconnect(ctx)
+}
+
+type mongoUserStore struct {
+	s   *mongoStorage
+	col *mongo.Collection
+}
+
+func (s *mongoUserStore) Find(ctx context.Context, username string) (*account, error) {
+	res := s.col.FindOne(ctx, bson.M{"username": username})
+	if err := res.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+
+	acc := &account{}
+	if err := res.Decode(acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (s *mongoUserStore) Create(ctx context.Context, acc *account, player *core.Player) error {
+	err := s.s.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := s.col.InsertOne(ctx, acc); err != nil {
+			return err
+		}
+
+		_, err := s.s.players.col.InsertOne(ctx, player)
+		return err
+	})
+
+	// the unique indexes guard the username and email
+	switch duplicateKeyIndex(err) {
+	case usernameIndex:
+		return errUsernameTaken
+	case emailIndex:
+		return errEmailTaken
+	}
+	return err
+}
+
+type mongoPlayerStore struct {
+	s   *mongoStorage
+	col *mongo.Collection
+}
+
+func (s *mongoPlayerStore) Find(ctx context.Context, username string) (*core.Player, error) {
+	res := s.col.FindOne(ctx, bson.M{"username": username})
+	if err := res.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+
+	player := &core.Player{}
+	if err := res.Decode(player); err != nil {
+		return nil, err
+	}
+	return player, nil
+}
+
+func (s *mongoPlayerStore) GuildMates(ctx context.Context, guild string, usernames []string) ([]*core.Player, error) {
+	cur, err := s.col.Find(ctx, bson.M{"guild": guild, "username": bson.M{"$in": usernames}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var players []*core.Player
+	for cur.Next(ctx) {
+		player := &core.Player{}
+		if err := cur.Decode(player); err != nil {
+			return nil, err
+		}
+		players = append(players, player)
+	}
+	return players, cur.Err()
+}
+
+func (s *mongoPlayerStore) UpdateProfile(ctx context.Context, username string, p *profile) (*core.Player, error) {
+	set := bson.M{}
+	if p.DisplayName != nil {
+		set["displayName"] = *p.DisplayName
+	}
+	if p.Avatar != nil {
+		set["avatar"] = *p.Avatar
+	}
+	if p.Bio != nil {
+		set["bio"] = *p.Bio
+	}
+
+	if len(set) == 0 {
+		return s.Find(ctx, username)
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	res := s.col.FindOneAndUpdate(ctx, bson.M{"username": username}, update, opts)
+	if err := res.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+
+	player := &core.Player{}
+	if err := res.Decode(player); err != nil {
+		return nil, err
+	}
+	return player, nil
+}
+
+func (s *mongoPlayerStore) Update(ctx context.Context, username string, cause cause, fn func(p *core.Player) error) (*core.Player, error) {
+	for i := 0; i < maxUpdateRetries; i++ {
+		var player *core.Player
+		// every attempt is a transaction of its own, so it can see the changes of the others
+		err := s.s.WithTx(ctx, func(ctx context.Context) error {
+			p, err := s.Find(ctx, username)
+			if err != nil {
+				return err
+			}
+
+			id, version, before := p.ID, p.Version, p.Resources()
+			if err := fn(p); err != nil {
+				return err
+			}
+			// the identity can't be changed by the fn
+			p.ID, p.Username = id, username
+			p.Version = version + 1
+
+			res, err := s.col.ReplaceOne(ctx, bson.M{"_id": id, "version": version}, p)
+			if err != nil {
+				return err
+			}
+			if res.MatchedCount == 0 {
+				return nil
+			}
+
+			if delta := p.Resources().Sub(before); !delta.IsZero() {
+				if _, err := s.s.ledger.col.InsertOne(ctx, cause.entry(p, delta)); err != nil {
+					return err
+				}
+			}
+			player = p
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if player != nil {
+			return player, nil
+		}
+	}
+	return nil, errUpdateConflict
+}
+
+func (s *mongoPlayerStore) AddResources(ctx context.Context, username string, delta core.Resources, cause cause) (*core.Player, error) {
+	// nothing changed, nothing to record
+	if delta.IsZero() {
+		return s.Find(ctx, username)
+	}
+	filter := bson.M{"username": username}
+	inc := bson.M{"version": 1}
+
+	amounts := []struct {
+		field string
+		n     int64
+	}{
+		{"gold", delta.Gold},
+		{"food", delta.Food},
+		{"wood", delta.Wood},
+		{"stone", delta.Stone},
+		{"iron", delta.Iron},
+		{"crystal", delta.Crystal},
+	}
+	for _, a := range amounts {
+		if a.n == 0 {
+			continue
+		}
+		inc[a.field] = a.n
+		// only spend what the player has
+		if a.n < 0 {
+			filter[a.field] = bson.M{"$gte": -a.n}
+		}
+	}
+
+	player := &core.Player{}
+	err := s.s.WithTx(ctx, func(ctx context.Context) error {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		res := s.col.FindOneAndUpdate(ctx, filter, bson.M{"$inc": inc}, opts)
+		if err := res.Err(); err != nil {
+			if err != mongo.ErrNoDocuments {
+				return err
+			}
+			// tell a missing player from a poor one
+			if _, err := s.Find(ctx, username); err != nil {
+				return err
+			}
+			return errInsufficientResources
+		}
+
+		if err := res.Decode(player); err != nil {
+			return err
+		}
+
+		_, err := s.s.ledger.col.InsertOne(ctx, cause.entry(player, delta))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return player, nil
+}
+
+func (s *mongoPlayerStore) RestoreResources(ctx context.Context, username string, balances core.Resources) (*core.Player, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$set": balances, "$inc": bson.M{"version": 1}}
+	res := s.col.FindOneAndUpdate(ctx, bson.M{"username": username}, update, opts)
+	if err := res.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+
+	player := &core.Player{}
+	if err := res.Decode(player); err != nil {
+		return nil, err
+	}
+	return player, nil
+}
+
+func (s *mongoPlayerStore) SetLastSeen(ctx context.Context, username string, t int64) error {
+	res, err := s.col.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"lastSeen": t}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+type mongoLedgerStore struct {
+	col *mongo.Collection
+}
+
+func (s *mongoLedgerStore) List(ctx context.Context, username string, q ledgerQuery) ([]*core.LedgerEntry, error) {
+	filter := bson.M{"username": username}
+	if q.Before > 0 {
+		filter["version"] = bson.M{"$lt": q.Before}
+	}
+	if len(q.Reason) > 0 {
+		filter["reason"] = q.Reason
+	}
+	if q.Limit <= 0 || q.Limit > maxLedgerLimit {
+		q.Limit = maxLedgerLimit
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: -1}}).SetLimit(q.Limit)
+	return s.find(ctx, filter, opts)
+}
+
+func (s *mongoLedgerStore) All(ctx context.Context, username string) ([]*core.LedgerEntry, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: 1}})
+	return s.find(ctx, bson.M{"username": username}, opts)
+}
+
+func (s *mongoLedgerStore) find(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]*core.LedgerEntry, error) {
+	cur, err := s.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	entries := []*core.LedgerEntry{}
+	for cur.Next(ctx) {
+		e := &core.LedgerEntry{}
+		if err := cur.Decode(e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, cur.Err()
+}
+
+type mongoChatStore struct {
+	col   *mongo.Collection
+	lists *mongo.Collection
+}
+
+func (s *mongoChatStore) Save(ctx context.Context, m *core.ChatMessage) error {
+	_, err := s.col.InsertOne(ctx, m)
+	return err
+}
+
+func (s *mongoChatStore) History(ctx context.Context, channel string, before primitive.ObjectID, limit int64) ([]*core.ChatMessage, error) {
+	filter := bson.M{"channel": channel, "deleted": bson.M{"$ne": true}}
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	if limit <= 0 || limit > maxChatLimit {
+		limit = maxChatLimit
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit)
+	cur, err := s.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	messages := []*core.ChatMessage{}
+	for cur.Next(ctx) {
+		m := &core.ChatMessage{}
+		if err := cur.Decode(m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, cur.Err()
+}
+
+func (s *mongoChatStore) Delete(ctx context.Context, id primitive.ObjectID, moderator string) (*core.ChatMessage, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	m := &core.ChatMessage{}
+	err := s.col.FindOneAndUpdate(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"deleted": true, "deletedBy": moderator}}, opts).Decode(m)
+	if err == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *mongoChatStore) Lists(ctx context.Context, username string) (*core.ChatLists, error) {
+	l := &core.ChatLists{}
+	err := s.lists.FindOne(ctx, bson.M{"_id": username}).Decode(l)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeChatLists(username, l), nil
+}
+
+func (s *mongoChatStore) SetListed(ctx context.Context, username, list, target string, listed bool) (*core.ChatLists, error) {
+	op := "$pull"
+	if listed {
+		op = "$addToSet"
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	l := &core.ChatLists{}
+	err := s.lists.FindOneAndUpdate(ctx, bson.M{"_id": username}, bson.M{op: bson.M{list: target}}, opts).Decode(l)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeChatLists(username, l), nil
+}
+
+// the lists never set are empty, not null
+func normalizeChatLists(username string, l *core.ChatLists) *core.ChatLists {
+	l.Username = username
+	if l.Muted == nil {
+		l.Muted = []string{}
+	}
+	if l.Blocked == nil {
+		l.Blocked = []string{}
+	}
+	return l
+}
+
+type mongoNotificationStore struct {
+	col   *mongo.Collection
+	prefs *mongo.Collection
+}
+
+func (s *mongoNotificationStore) Add(ctx context.Context, n *core.Notification) error {
+	_, err := s.col.InsertOne(ctx, n)
+	return err
+}
+
+func (s *mongoNotificationStore) List(ctx context.Context, username string, q notificationQuery) ([]*core.Notification, error) {
+	filter := bson.M{"username": username}
+	if !q.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": q.Before}
+	}
+	if q.Unread {
+		filter["read"] = false
+	}
+	if q.Limit <= 0 || q.Limit > maxNotificationLimit {
+		q.Limit = maxNotificationLimit
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(q.Limit)
+	cur, err := s.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	list := []*core.Notification{}
+	for cur.Next(ctx) {
+		n := &core.Notification{}
+		if err := cur.Decode(n); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, cur.Err()
+}
+
+func (s *mongoNotificationStore) MarkRead(ctx context.Context, username string, ids []primitive.ObjectID) (int64, error) {
+	filter := bson.M{"username": username, "read": false}
+	if len(ids) > 0 {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	res, err := s.col.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"read": true}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoNotificationStore) Delete(ctx context.Context, username string, id primitive.ObjectID) error {
+	res, err := s.col.DeleteOne(ctx, bson.M{"_id": id, "username": username})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *mongoNotificationStore) Prefs(ctx context.Context, username string) (*core.NotificationPrefs, error) {
+	p := &core.NotificationPrefs{}
+	err := s.prefs.FindOne(ctx, bson.M{"_id": username}).Decode(p)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeNotificationPrefs(username, p), nil
+}
+
+func (s *mongoNotificationStore) SetPrefs(ctx context.Context, username string, prefs map[string]core.NotificationPref) (*core.NotificationPrefs, error) {
+	set := bson.M{}
+	for category, pref := range prefs {
+		set["categories."+category] = pref
+	}
+	if len(set) == 0 {
+		return s.Prefs(ctx, username)
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	p := &core.NotificationPrefs{}
+	err := s.prefs.FindOneAndUpdate(ctx, bson.M{"_id": username}, bson.M{"$set": set}, opts).Decode(p)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeNotificationPrefs(username, p), nil
+}
+
+// the preferences never set are empty, not null
+func normalizeNotificationPrefs(username string, p *core.NotificationPrefs) *core.NotificationPrefs {
+	p.Username = username
+	if p.Categories == nil {
+		p.Categories = make(map[string]core.NotificationPref)
+	}
+	return p
+}
@@ -0,0 +1,145 @@
+package vanilla
+
+import (
+	"context"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+// observedStorage wraps a storage, and reports every change of the players to the changed once it's saved,
+// and the resources added with their cause to the added,
+// the changes in a transaction are reported after it's committed, none if it's rolled back,
+// the last seen is not a change of the game state, it's not reported
+type observedStorage struct {
+	st      storage
+	changed func(p *core.Player)
+	added   func(p *core.Player, delta core.Resources, c cause)
+}
+
+// the ctx key of the reports pending in a transaction
+type changesKey struct{}
+
+func newObservedStorage(st storage, changed func(p *core.Player), added func(p *core.Player, delta core.Resources, c cause)) *observedStorage {
+	return &observedStorage{st: st, changed: changed, added: added}
+}
+
+func (s *observedStorage) Users() userStore     { return observedUserStore{s, s.st.Users()} }
+func (s *observedStorage) Players() playerStore { return observedPlayerStore{s, s.st.Players()} }
+func (s *observedStorage) Ledger() ledgerStore  { return s.st.Ledger() }
+func (s *observedStorage) Chat() chatStore      { return s.st.Chat() }
+func (s *observedStorage) Notifications() notificationStore {
+	return s.st.Notifications()
+}
+
+func (s *observedStorage) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(changesKey{}) != nil {
+		return s.st.WithTx(ctx, fn)
+	}
+
+	var pending []func()
+	err := s.st.WithTx(ctx, func(ctx context.Context) error {
+		// the fn may be called again
+		pending = pending[:0]
+		return fn(context.WithValue(ctx, changesKey{}, &pending))
+	})
+	if err != nil {
+		return err
+	}
+	for _, report := range pending {
+		report()
+	}
+	return nil
+}
+
+func (s *observedStorage) Ping(ctx context.Context) error {
+	return s.st.Ping(ctx)
+}
+
+func (s *observedStorage) Close(ctx context.Context) error {
+	return s.st.Close(ctx)
+}
+
+// report the change, or keep it until the transaction of the ctx is committed
+func (s *observedStorage) report(ctx context.Context, p *core.Player) {
+	// the caller may change it before the commit
+	p = clonePlayer(p)
+	s.later(ctx, func() { s.changed(p) })
+}
+
+// run the report now, or once the transaction of the ctx is committed
+func (s *observedStorage) later(ctx context.Context, report func()) {
+	if pending, ok := ctx.Value(changesKey{}).(*[]func()); ok {
+		*pending = append(*pending, report)
+		return
+	}
+	report()
+}
+
+type observedUserStore struct {
+	s     *observedStorage
+	users userStore
+}
+
+func (u observedUserStore) Find(ctx context.Context, username string) (*account, error) {
+	return u.users.Find(ctx, username)
+}
+
+func (u observedUserStore) Create(ctx context.Context, acc *account, player *core.Player) error {
+	if err := u.users.Create(ctx, acc, player); err != nil {
+		return err
+	}
+	u.s.report(ctx, player)
+	return nil
+}
+
+type observedPlayerStore struct {
+	s       *observedStorage
+	players playerStore
+}
+
+func (p observedPlayerStore) Find(ctx context.Context, username string) (*core.Player, error) {
+	return p.players.Find(ctx, username)
+}
+
+func (p observedPlayerStore) GuildMates(ctx context.Context, guild string, usernames []string) ([]*core.Player, error) {
+	return p.players.GuildMates(ctx, guild, usernames)
+}
+
+func (p observedPlayerStore) UpdateProfile(ctx context.Context, username string, pf *profile) (*core.Player, error) {
+	return p.observe(ctx)(p.players.UpdateProfile(ctx, username, pf))
+}
+
+func (p observedPlayerStore) Update(ctx context.Context, username string, c cause, fn func(*core.Player) error) (*core.Player, error) {
+	return p.observe(ctx)(p.players.Update(ctx, username, c, fn))
+}
+
+func (p observedPlayerStore) AddResources(ctx context.Context, username string, delta core.Resources, c cause) (*core.Player, error) {
+	// nothing changed, nothing to report
+	if delta.IsZero() {
+		return p.players.AddResources(ctx, username, delta, c)
+	}
+	player, err := p.observe(ctx)(p.players.AddResources(ctx, username, delta, c))
+	if err == nil && p.s.added != nil {
+		added := clonePlayer(player)
+		p.s.later(ctx, func() { p.s.added(added, delta, c) })
+	}
+	return player, err
+}
+
+func (p observedPlayerStore) RestoreResources(ctx context.Context, username string, balances core.Resources) (*core.Player, error) {
+	return p.observe(ctx)(p.players.RestoreResources(ctx, username, balances))
+}
+
+func (p observedPlayerStore) SetLastSeen(ctx context.Context, username string, t int64) error {
+	return p.players.SetLastSeen(ctx, username, t)
+}
+
+// observe the result of a change
+func (p observedPlayerStore) observe(ctx context.Context) func(*core.Player, error) (*core.Player, error) {
+	return func(player *core.Player, err error) (*core.Player, error) {
+		if err == nil {
+			p.s.report(ctx, player)
+		}
+		return player, err
+	}
+}
@@ -0,0 +1,231 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+var testCause = cause{Reason: "test", Source: "test"}
+
+func createTestPlayer(t *testing.T, st storage, username string) {
+	acc := &account{ID: primitive.NewObjectID(), Username: username, Email: username + "@vanilla.com"}
+	player := &core.Player{ID: primitive.NewObjectID(), Username: username, Created: time.Now().Unix()}
+	if err := st.Users().Create(context.Background(), acc, player); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	st := newMemoryStorage()
+	ctx := context.Background()
+	createTestPlayer(t, st, "aspirin2d")
+
+	acc, err := st.Users().Find(ctx, "aspirin2d")
+	assert.Nil(t, err)
+	assert.Equal(t, "aspirin2d@vanilla.com", acc.Email)
+
+	_, err = st.Users().Find(ctx, "nobody_here")
+	assert.Equal(t, errNotFound, err)
+
+	// duplicated username and email
+	err = st.Users().Create(ctx, &account{Username: "aspirin2d", Email: "other@vanilla.com"}, &core.Player{Username: "aspirin2d"})
+	assert.Equal(t, errUsernameTaken, err)
+	err = st.Users().Create(ctx, &account{Username: "another", Email: "aspirin2d@vanilla.com"}, &core.Player{Username: "another"})
+	assert.Equal(t, errEmailTaken, err)
+}
+
+func TestMemoryPlayerStore(t *testing.T) {
+	st := newMemoryStorage()
+	ctx := context.Background()
+	createTestPlayer(t, st, "aspirin2d")
+
+	p, err := st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: 100}, testCause)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), p.Gold)
+	assert.Equal(t, int64(1), p.Version)
+
+	// can't spend more than the player has
+	_, err = st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: -50, Wood: -1}, testCause)
+	assert.Equal(t, errInsufficientResources, err)
+	_, err = st.Players().AddResources(ctx, "nobody_here", core.Resources{Gold: 1}, testCause)
+	assert.Equal(t, errNotFound, err)
+
+	// nothing changed, nothing recorded
+	p, err = st.Players().AddResources(ctx, "aspirin2d", core.Resources{}, testCause)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), p.Version)
+	entries, err := st.Ledger().All(ctx, "aspirin2d")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// concurrent updates never lose any gold
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: -1}, testCause)
+			assert.Nil(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			// a conflict is fine, the gold must stay consistent anyway
+			st.Players().Update(ctx, "aspirin2d", testCause, func(p *core.Player) error {
+				p.Food++
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	p, err = st.Players().Find(ctx, "aspirin2d")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(90), p.Gold)
+	assert.Equal(t, int64(1)+10+p.Food, p.Version)
+}
+
+func TestMemoryWithTx(t *testing.T) {
+	st := newMemoryStorage()
+	ctx := context.Background()
+	createTestPlayer(t, st, "aspirin2d")
+	createTestPlayer(t, st, "bob_the_builder")
+
+	// a failed transaction changes nothing
+	errBoom := errors.New("boom")
+	err := st.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: 10}, testCause); err != nil {
+			return err
+		}
+		if _, err := st.Players().AddResources(ctx, "bob_the_builder", core.Resources{Gold: 10}, testCause); err != nil {
+			return err
+		}
+		return errBoom
+	})
+	assert.Equal(t, errBoom, err)
+
+	p, _ := st.Players().Find(ctx, "aspirin2d")
+	assert.Equal(t, int64(0), p.Gold)
+
+	// transfer the gold, all or nothing
+	err = st.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := st.Players().AddResources(ctx, "bob_the_builder", core.Resources{Gold: 10}, testCause); err != nil {
+			return err
+		}
+		_, err := st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: -10}, testCause)
+		return err
+	})
+	assert.Equal(t, errInsufficientResources, err)
+
+	p, _ = st.Players().Find(ctx, "bob_the_builder")
+	assert.Equal(t, int64(0), p.Gold)
+}
+
+func TestMongoUserStore(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	if err := ensureIndexes(ctx, db, indexes); err != nil {
+		t.Fatal(err)
+	}
+	st := newMongoStorage(db)
+	createTestPlayer(t, st, "aspirin2d")
+
+	// the duplicate key of the unique indexes, and nothing left of the failed transaction
+	err := st.Users().Create(ctx, &account{ID: primitive.NewObjectID(), Username: "aspirin2d", Email: "other@vanilla.com"},
+		&core.Player{ID: primitive.NewObjectID(), Username: "aspirin2d"})
+	assert.Equal(t, errUsernameTaken, err)
+	err = st.Users().Create(ctx, &account{ID: primitive.NewObjectID(), Username: "another", Email: "aspirin2d@vanilla.com"},
+		&core.Player{ID: primitive.NewObjectID(), Username: "another"})
+	assert.Equal(t, errEmailTaken, err)
+	_, err = st.Players().Find(ctx, "another")
+	assert.Equal(t, errNotFound, err)
+}
+
+func TestMongoConcurrentSpends(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	if err := ensureIndexes(ctx, db, indexes); err != nil {
+		t.Fatal(err)
+	}
+	st := newMongoStorage(db)
+	createTestPlayer(t, st, "aspirin2d")
+
+	_, err := st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: 100}, testCause)
+	assert.Nil(t, err)
+
+	// twice as many spends as the gold, only half of them succeed
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	spent, poor := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := st.Players().AddResources(ctx, "aspirin2d", core.Resources{Gold: -10}, testCause)
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				spent++
+			case errInsufficientResources:
+				poor++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 10, spent)
+	assert.Equal(t, 10, poor)
+
+	p, err := st.Players().Find(ctx, "aspirin2d")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), p.Gold)
+	assert.Equal(t, int64(11), p.Version)
+
+	// the ledger replays to the balance
+	entries, err := st.Ledger().All(ctx, "aspirin2d")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 11)
+	var sum core.Resources
+	for _, e := range entries {
+		sum = sum.Add(e.Delta)
+	}
+	assert.Equal(t, p.Resources(), sum)
+}
+
+// the guild mates are found in one query, the others are left out
+func testGuildMates(t *testing.T, st storage) {
+	ctx := context.Background()
+	for _, username := range []string{"aspirin2d", "ibuprofen", "paracetamol"} {
+		createTestPlayer(t, st, username)
+	}
+	for _, username := range []string{"aspirin2d", "ibuprofen"} {
+		_, err := st.Players().Update(ctx, username, testCause, func(p *core.Player) error {
+			p.Guild = "knights"
+			return nil
+		})
+		assert.Nil(t, err)
+	}
+
+	players, err := st.Players().GuildMates(ctx, "knights", []string{"ibuprofen", "paracetamol", "nobody_here"})
+	assert.Nil(t, err)
+	if assert.Len(t, players, 1) {
+		assert.Equal(t, "ibuprofen", players[0].Username)
+	}
+}
+
+func TestMemoryGuildMates(t *testing.T) {
+	testGuildMates(t, newMemoryStorage())
+}
+
+func TestMongoGuildMates(t *testing.T) {
+	testGuildMates(t, newMongoStorage(testMongo(t)))
+}
@@ -0,0 +1,209 @@
+package vanilla
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/trace"
+
+	core "github.com/sleep2death/vanilla/core"
+)
+
+// tracedStorage wraps a storage, and traces every call of it
+type tracedStorage struct {
+	st     storage
+	tracer trace.Tracer
+}
+
+func newTracedStorage(st storage, tracer trace.Tracer) *tracedStorage {
+	return &tracedStorage{st: st, tracer: tracer}
+}
+
+func (s *tracedStorage) start(ctx context.Context, name, username string) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindInternal)}
+	if len(username) > 0 {
+		opts = append(opts, trace.WithAttributes(usernameKey.String(username)))
+	}
+	return s.tracer.Start(ctx, "store."+name, opts...)
+}
+
+func (s *tracedStorage) Users() userStore     { return tracedUserStore{s, s.st.Users()} }
+func (s *tracedStorage) Players() playerStore { return tracedPlayerStore{s, s.st.Players()} }
+func (s *tracedStorage) Ledger() ledgerStore  { return tracedLedgerStore{s, s.st.Ledger()} }
+func (s *tracedStorage) Chat() chatStore      { return tracedChatStore{s, s.st.Chat()} }
+func (s *tracedStorage) Notifications() notificationStore {
+	return tracedNotificationStore{s, s.st.Notifications()}
+}
+
+func (s *tracedStorage) WithTx(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	ctx, span := s.start(ctx, "tx", "")
+	defer func() { endSpan(span, err) }()
+	return s.st.WithTx(ctx, fn)
+}
+
+func (s *tracedStorage) Ping(ctx context.Context) (err error) {
+	ctx, span := s.start(ctx, "ping", "")
+	defer func() { endSpan(span, err) }()
+	return s.st.Ping(ctx)
+}
+
+func (s *tracedStorage) Close(ctx context.Context) error {
+	return s.st.Close(ctx)
+}
+
+type tracedUserStore struct {
+	s     *tracedStorage
+	users userStore
+}
+
+func (u tracedUserStore) Find(ctx context.Context, username string) (acc *account, err error) {
+	ctx, span := u.s.start(ctx, "users.find", username)
+	defer func() { endSpan(span, err) }()
+	return u.users.Find(ctx, username)
+}
+
+func (u tracedUserStore) Create(ctx context.Context, acc *account, player *core.Player) (err error) {
+	ctx, span := u.s.start(ctx, "users.create", acc.Username)
+	defer func() { endSpan(span, err) }()
+	return u.users.Create(ctx, acc, player)
+}
+
+type tracedPlayerStore struct {
+	s       *tracedStorage
+	players playerStore
+}
+
+func (p tracedPlayerStore) Find(ctx context.Context, username string) (player *core.Player, err error) {
+	ctx, span := p.s.start(ctx, "players.find", username)
+	defer func() { endSpan(span, err) }()
+	return p.players.Find(ctx, username)
+}
+
+func (p tracedPlayerStore) UpdateProfile(ctx context.Context, username string, pf *profile) (player *core.Player, err error) {
+	ctx, span := p.s.start(ctx, "players.update_profile", username)
+	defer func() { endSpan(span, err) }()
+	return p.players.UpdateProfile(ctx, username, pf)
+}
+
+func (p tracedPlayerStore) Update(ctx context.Context, username string, c cause, fn func(*core.Player) error) (player *core.Player, err error) {
+	ctx, span := p.s.start(ctx, "players.update", username)
+	defer func() { endSpan(span, err) }()
+	return p.players.Update(ctx, username, c, fn)
+}
+
+func (p tracedPlayerStore) AddResources(ctx context.Context, username string, delta core.Resources, c cause) (player *core.Player, err error) {
+	ctx, span := p.s.start(ctx, "players.add_resources", username)
+	defer func() { endSpan(span, err) }()
+	return p.players.AddResources(ctx, username, delta, c)
+}
+
+func (p tracedPlayerStore) RestoreResources(ctx context.Context, username string, balances core.Resources) (player *core.Player, err error) {
+	ctx, span := p.s.start(ctx, "players.restore_resources", username)
+	defer func() { endSpan(span, err) }()
+	return p.players.RestoreResources(ctx, username, balances)
+}
+
+func (p tracedPlayerStore) GuildMates(ctx context.Context, guild string, usernames []string) (players []*core.Player, err error) {
+	ctx, span := p.s.start(ctx, "players.guild_mates", "")
+	defer func() { endSpan(span, err) }()
+	return p.players.GuildMates(ctx, guild, usernames)
+}
+
+func (p tracedPlayerStore) SetLastSeen(ctx context.Context, username string, t int64) (err error) {
+	ctx, span := p.s.start(ctx, "players.set_last_seen", username)
+	defer func() { endSpan(span, err) }()
+	return p.players.SetLastSeen(ctx, username, t)
+}
+
+type tracedLedgerStore struct {
+	s      *tracedStorage
+	ledger ledgerStore
+}
+
+func (l tracedLedgerStore) List(ctx context.Context, username string, q ledgerQuery) (entries []*core.LedgerEntry, err error) {
+	ctx, span := l.s.start(ctx, "ledger.list", username)
+	defer func() { endSpan(span, err) }()
+	return l.ledger.List(ctx, username, q)
+}
+
+func (l tracedLedgerStore) All(ctx context.Context, username string) (entries []*core.LedgerEntry, err error) {
+	ctx, span := l.s.start(ctx, "ledger.all", username)
+	defer func() { endSpan(span, err) }()
+	return l.ledger.All(ctx, username)
+}
+
+type tracedChatStore struct {
+	s    *tracedStorage
+	chat chatStore
+}
+
+func (c tracedChatStore) Save(ctx context.Context, m *core.ChatMessage) (err error) {
+	ctx, span := c.s.start(ctx, "chat.save", m.From)
+	defer func() { endSpan(span, err) }()
+	return c.chat.Save(ctx, m)
+}
+
+func (c tracedChatStore) History(ctx context.Context, channel string, before primitive.ObjectID, limit int64) (messages []*core.ChatMessage, err error) {
+	ctx, span := c.s.start(ctx, "chat.history", "")
+	defer func() { endSpan(span, err) }()
+	return c.chat.History(ctx, channel, before, limit)
+}
+
+func (c tracedChatStore) Delete(ctx context.Context, id primitive.ObjectID, moderator string) (m *core.ChatMessage, err error) {
+	ctx, span := c.s.start(ctx, "chat.delete", moderator)
+	defer func() { endSpan(span, err) }()
+	return c.chat.Delete(ctx, id, moderator)
+}
+
+func (c tracedChatStore) Lists(ctx context.Context, username string) (l *core.ChatLists, err error) {
+	ctx, span := c.s.start(ctx, "chat.lists", username)
+	defer func() { endSpan(span, err) }()
+	return c.chat.Lists(ctx, username)
+}
+
+func (c tracedChatStore) SetListed(ctx context.Context, username, list, target string, listed bool) (l *core.ChatLists, err error) {
+	ctx, span := c.s.start(ctx, "chat.set_listed", username)
+	defer func() { endSpan(span, err) }()
+	return c.chat.SetListed(ctx, username, list, target, listed)
+}
+
+type tracedNotificationStore struct {
+	s     *tracedStorage
+	notes notificationStore
+}
+
+func (n tracedNotificationStore) Add(ctx context.Context, note *core.Notification) (err error) {
+	ctx, span := n.s.start(ctx, "notifications.add", note.Username)
+	defer func() { endSpan(span, err) }()
+	return n.notes.Add(ctx, note)
+}
+
+func (n tracedNotificationStore) List(ctx context.Context, username string, q notificationQuery) (list []*core.Notification, err error) {
+	ctx, span := n.s.start(ctx, "notifications.list", username)
+	defer func() { endSpan(span, err) }()
+	return n.notes.List(ctx, username, q)
+}
+
+func (n tracedNotificationStore) MarkRead(ctx context.Context, username string, ids []primitive.ObjectID) (changed int64, err error) {
+	ctx, span := n.s.start(ctx, "notifications.mark_read", username)
+	defer func() { endSpan(span, err) }()
+	return n.notes.MarkRead(ctx, username, ids)
+}
+
+func (n tracedNotificationStore) Delete(ctx context.Context, username string, id primitive.ObjectID) (err error) {
+	ctx, span := n.s.start(ctx, "notifications.delete", username)
+	defer func() { endSpan(span, err) }()
+	return n.notes.Delete(ctx, username, id)
+}
+
+func (n tracedNotificationStore) Prefs(ctx context.Context, username string) (p *core.NotificationPrefs, err error) {
+	ctx, span := n.s.start(ctx, "notifications.prefs", username)
+	defer func() { endSpan(span, err) }()
+	return n.notes.Prefs(ctx, username)
+}
+
+func (n tracedNotificationStore) SetPrefs(ctx context.Context, username string, prefs map[string]core.NotificationPref) (p *core.NotificationPrefs, err error) {
+	ctx, span := n.s.start(ctx, "notifications.set_prefs", username)
+	defer func() { endSpan(span, err) }()
+	return n.notes.SetPrefs(ctx, username, prefs)
+}
@@ -0,0 +1,168 @@
+package vanilla
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	// the workbook has no sheet
+	errNoTables = errors.New("no config tables")
+)
+
+// table is a sheet of the config workbook, the first row is the header
+type table struct {
+	Name   string
+	Header []string
+	Rows   [][]string
+}
+
+// the xml parts of the xlsx workbook which the loader needs
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxSharedStrings struct {
+	Items []struct {
+		// plain text, or the runs of a rich text
+		T string   `xml:"t"`
+		R []string `xml:"r>t"`
+	} `xml:"si"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string `xml:"r,attr"`
+			Type   string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// loadTables loads every sheet of the xlsx workbook, by sheet name
+func loadTables(file string) (map[string]*table, error) {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	parts := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		parts[f.Name] = f
+	}
+	decode := func(name string, v interface{}) error {
+		f, ok := parts[name]
+		if !ok {
+			return fmt.Errorf("%s not found in %s", name, file)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return xml.NewDecoder(r).Decode(v)
+	}
+
+	var wb xlsxWorkbook
+	if err := decode("xl/workbook.xml", &wb); err != nil {
+		return nil, err
+	}
+	var rels xlsxRelationships
+	if err := decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string)
+	for _, rel := range rels.Relationships {
+		targets[rel.ID] = path.Join("xl", rel.Target)
+	}
+
+	// a workbook of numbers only has no shared strings
+	var sst xlsxSharedStrings
+	if _, ok := parts["xl/sharedStrings.xml"]; ok {
+		if err := decode("xl/sharedStrings.xml", &sst); err != nil {
+			return nil, err
+		}
+	}
+	shared := make([]string, len(sst.Items))
+	for i, si := range sst.Items {
+		shared[i] = si.T + strings.Join(si.R, "")
+	}
+
+	tables := make(map[string]*table)
+	for _, s := range wb.Sheets {
+		var sheet xlsxSheet
+		if err := decode(targets[s.RID], &sheet); err != nil {
+			return nil, err
+		}
+
+		t := &table{Name: s.Name}
+		for i, row := range sheet.Rows {
+			var values []string
+			for _, c := range row.Cells {
+				col := columnIndex(c.Ref)
+				if col < 0 {
+					// the reference is optional, then it's the next column
+					col = len(values)
+				}
+				for len(values) <= col {
+					values = append(values, "")
+				}
+
+				v := c.Value
+				switch c.Type {
+				case "s":
+					n, err := strconv.Atoi(v)
+					if err != nil || n < 0 || n >= len(shared) {
+						return nil, fmt.Errorf("bad shared string %s in %s!%s", v, s.Name, c.Ref)
+					}
+					v = shared[n]
+				case "inlineStr":
+					v = c.Inline
+				}
+				values[col] = strings.TrimSpace(v)
+			}
+
+			if i == 0 {
+				t.Header = values
+			} else {
+				t.Rows = append(t.Rows, values)
+			}
+		}
+		tables[s.Name] = t
+	}
+
+	if len(tables) == 0 {
+		return nil, errNoTables
+	}
+	return tables, nil
+}
+
+// zero based column index of the cell reference, "C5" is 2
+func columnIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
@@ -0,0 +1,29 @@
+package vanilla
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTables(t *testing.T) {
+	tables, err := loadTables("config/config.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	races := tables["Race Base Stats"]
+	if assert.NotNil(t, races) {
+		assert.Equal(t, []string{"Race", "Str", "Agi", "Sta", "Int", "Spi"}, races.Header)
+		assert.Len(t, races.Rows, 8)
+		assert.Equal(t, "Human", races.Rows[0][0])
+		assert.Equal(t, "20", races.Rows[0][1])
+	}
+	assert.NotNil(t, tables["Class Bonus Stats"])
+
+	_, err = loadTables("config/not_existed.xlsx")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 0, columnIndex("A1"))
+	assert.Equal(t, 27, columnIndex("AB12"))
+}
@@ -0,0 +1,113 @@
+package vanilla
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// minimum interval to check the certificate files for changes
+const certCheckInterval = time.Second * 10
+
+// certReloader serves the certificate loaded from the files, and reloads it when they change,
+// so the renewed certificates are picked up without restarting
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+
+	log logrus.FieldLogger
+}
+
+// load the certificate from the files, it must be valid at startup
+func newCertReloader(certFile, keyFile string, log logrus.FieldLogger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: certCheckInterval, log: log}
+
+	modTime, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cert, r.modTime, r.checked = &cert, modTime, time.Now()
+	return r, nil
+}
+
+// GetCertificate for tls.Config
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= r.interval {
+		r.checked = time.Now()
+		r.reload()
+	}
+	return r.cert, nil
+}
+
+// reload the certificate if the files changed, keep the old one if they are broken,
+// which happens while they're being rewritten
+func (r *certReloader) reload() {
+	modTime, err := r.stat()
+	if err != nil {
+		r.log.WithError(err).Warn("failed to check the certificate")
+		return
+	}
+	if !modTime.After(r.modTime) {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		r.log.WithError(err).Warn("failed to reload the certificate")
+		return
+	}
+	r.cert, r.modTime = &cert, modTime
+	r.log.Info("certificate reloaded")
+}
+
+// the latest modification time of the files
+func (r *certReloader) stat() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// getRedirectHandler redirects every plain http request to the https one on the port
+func getRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// no port in the host
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		url := "https://" + host + r.URL.RequestURI()
+		// keep the method and the body
+		http.Redirect(w, r, url, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,153 @@
+package vanilla
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// write a self-signed certificate of 127.0.0.1 to the files
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vanilla")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.TLSCertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLSKeyFile = filepath.Join(dir, "key.pem")
+	cfg.RedirectAddr = "127.0.0.1:0"
+	writeTestCert(t, cfg.TLSCertFile, cfg.TLSKeyFile, "first")
+
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true},
+		// don't follow the redirects
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// served over HTTP/2
+	resp, err := client.Get("https://" + s.Addr() + "/api/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "first", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// plain http is redirected to https
+	resp, err = client.Get("http://" + s.redirectListener.Addr().String() + "/api/ping?a=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+	_, port, _ := net.SplitHostPort(s.Addr())
+	assert.Equal(t, "https://127.0.0.1:"+port+"/api/ping?a=b", resp.Header.Get("Location"))
+
+	// websocket over tls
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the websocket handshake is HTTP/1.1 only, don't offer h2
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn, _, err := dialWS(dialer, "wss://"+s.Addr()+"/ws", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// the renewed certificate is picked up without restarting
+	writeTestCert(t, cfg.TLSCertFile, cfg.TLSKeyFile, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.TLSCertFile, later, later)
+	s.certs.mu.Lock()
+	s.certs.interval = 0
+	s.certs.mu.Unlock()
+
+	conn2, err := tls.Dial("tcp", s.Addr(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	assert.Equal(t, "second", conn2.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
+
+func TestTLSMissingCert(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.TLSCertFile = filepath.Join(os.TempDir(), "vanilla-missing-cert.pem")
+	cfg.TLSKeyFile = filepath.Join(os.TempDir(), "vanilla-missing-key.pem")
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.st = newMemoryStorage()
+	assert.Error(t, s.Start(context.Background()))
+
+	// the hub started is stopped again
+	select {
+	case <-s.hub.stop:
+	default:
+		t.Error("hub not stopped")
+	}
+	assert.Empty(t, s.Addr())
+}
@@ -0,0 +1,182 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the name of the instrumentation
+const tracerName = "github.com/sleep2death/vanilla"
+
+var (
+	// the w3c traceparent and tracestate headers
+	propagator = propagation.TraceContext{}
+
+	// the span attributes of the game
+	usernameKey = attribute.Key("vanilla.username")
+	connIDKey   = attribute.Key("vanilla.conn_id")
+)
+
+// newTracerProvider with the exporter of the config, the spans are recorded but not exported if there is none
+func newTracerProvider(cfg Config) (*sdktrace.TracerProvider, error) {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("vanilla"))),
+	}
+
+	switch cfg.TraceExporter {
+	case "":
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case "otlp":
+		var eopts []otlptracehttp.Option
+		if len(cfg.TraceEndpoint) > 0 {
+			eopts = append(eopts, otlptracehttp.WithEndpoint(cfg.TraceEndpoint))
+		}
+		if cfg.TraceInsecure {
+			eopts = append(eopts, otlptracehttp.WithInsecure())
+		}
+		// nothing is connected until the first export
+		exp, err := otlptracehttp.New(context.Background(), eopts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", cfg.TraceExporter)
+	}
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+// traceMiddleware continues the trace of the traceparent header, or starts a new one,
+// the span is in the context of the request
+func traceMiddleware(tracer trace.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(c.Request.URL.Path),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(logKey, requestLog(c).WithField("trace_id", span.SpanContext().TraceID().String()))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(status))
+	}
+}
+
+// end the span, recording the err if it's a failure
+func endSpan(span trace.Span, err error) {
+	// not found is an answer, not a failure
+	if err != nil && err != errNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// mongoTracer traces the mongodb commands, in the span of the operation which runs them
+type mongoTracer struct {
+	tracer trace.Tracer
+
+	mu    sync.Mutex
+	spans map[int64]trace.Span
+}
+
+func newMongoTracer(tracer trace.Tracer) *mongoTracer {
+	return &mongoTracer{tracer: tracer, spans: make(map[int64]trace.Span)}
+}
+
+func (t *mongoTracer) monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			_, span := t.tracer.Start(ctx, "mongo."+e.CommandName,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.DBSystemMongoDB,
+					semconv.DBNameKey.String(e.DatabaseName),
+					semconv.DBOperationKey.String(e.CommandName),
+				))
+			t.mu.Lock()
+			t.spans[e.RequestID] = span
+			t.mu.Unlock()
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			if span := t.pop(e.RequestID); span != nil {
+				span.End()
+			}
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			if span := t.pop(e.RequestID); span != nil {
+				endSpan(span, errors.New(e.Failure))
+			}
+		},
+	}
+}
+
+func (t *mongoTracer) pop(id int64) trace.Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	span := t.spans[id]
+	delete(t.spans, id)
+	return span
+}
+
+// joinMonitors calls all the monitors for every event
+func joinMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
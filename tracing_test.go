@@ -0,0 +1,72 @@
+package vanilla
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := tracetest.NewSpanRecorder()
+	s.tp.RegisterSpanProcessor(rec)
+
+	// continue the trace of the caller
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("GET", "/api/players/aspirin2d", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range rec.Ended() {
+		spans[span.Name()] = span
+	}
+	if !assert.Contains(t, spans, "GET /api/players/:name") || !assert.Contains(t, spans, "store.players.find") {
+		return
+	}
+
+	server, find := spans["GET /api/players/:name"], spans["store.players.find"]
+	assert.Equal(t, traceID, server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, server.SpanContext().SpanID(), find.Parent().SpanID())
+	assert.Equal(t, codes.Unset, find.Status().Code)
+}
+
+func TestMongoTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	m := newMongoTracer(tp.Tracer(tracerName)).monitor()
+
+	ctx, parent := tp.Tracer(tracerName).Start(context.Background(), "parent")
+	m.Started(ctx, &event.CommandStartedEvent{CommandName: "find", DatabaseName: DBName, RequestID: 1})
+	m.Started(ctx, &event.CommandStartedEvent{CommandName: "insert", DatabaseName: DBName, RequestID: 2})
+	m.Failed(ctx, &event.CommandFailedEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "insert", RequestID: 2}, Failure: "boom"})
+	m.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", RequestID: 1}})
+	parent.End()
+
+	spans := rec.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	assert.Equal(t, "mongo.insert", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "mongo.find", spans[1].Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[1].Parent().SpanID())
+}
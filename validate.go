@@ -23,6 +23,14 @@ func (l login) Validate() error {
 	)
 }
 
+func (p profile) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.DisplayName, validation.NilOrNotEmpty, validation.Length(1, 24)),
+		validation.Field(&p.Avatar, is.URL, validation.Length(0, 256)),
+		validation.Field(&p.Bio, validation.Length(0, 256)),
+	)
+}
+
 func getMatch(pattern string) validation.RuleFunc {
 	return func(value interface{}) error {
 		s, _ := value.(string)
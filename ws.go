@@ -1,149 +1,492 @@
 package vanilla
 
 import (
-	"bytes"
+	"compress/flate"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/mongo"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	core "github.com/sleep2death/vanilla/core"
 )
 
 const (
-	// time allowed to write a message to the peer.
-	writeWait = 30 * time.Second
+	// time allowed for the peer to answer the close frame.
+	closeGracePeriod = time.Second
+)
 
-	// time allowed to read the next pong message from the peer.
-	pongWait = 2 * time.Second
+var (
+	// no handler of the message type
+	errUnknownMessage = errors.New("unknown message type")
+	// the send queue of the client is full
+	errSendQueueFull = errors.New("send queue full")
+	// the message of the peer is over the read limit
+	errMessageTooBig = errors.New("message too big")
+)
 
-	// send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+// WSConfig of the websocket connections
+type WSConfig struct {
+	// maximum message size allowed from the peer, the bigger ones close the connection with 1009
+	ReadLimit int64
+	// the buffer sizes of the connection
+	ReadBufferSize  int
+	WriteBufferSize int
+	// send pings to the peer with this period, must be less than the PongTimeout
+	PingInterval time.Duration
+	// time allowed to read the next pong, or any message, from the peer
+	PongTimeout time.Duration
+	// time allowed to write a message to the peer
+	WriteTimeout time.Duration
+	// the outbound messages pending for a connection, at most
+	SendQueueSize int
+	// what to do when the send queue is full
+	Overflow OverflowPolicy
+	// permessage-deflate, if the peer offers it
+	Compression bool
+	// the flate compression level, from -2 to 9
+	CompressionLevel int
+	// the messages kept for the session resumption, at most
+	ResumeBuffer int
+	// how long a disconnected session can be resumed
+	ResumeTimeout time.Duration
+	// how long the presence of a user on a node lasts in the broker, renewed every third of it while connected
+	PresenceTTL time.Duration
+	// a connection without any message for this long is away
+	AwayAfter time.Duration
+}
 
-	// maximum message size allowed from peer.
-	maxMessageSize = 512
-)
+// DefaultWSConfig of the game clients
+func DefaultWSConfig() WSConfig {
+	return WSConfig{
+		ReadLimit:        4096,
+		ReadBufferSize:   1024,
+		WriteBufferSize:  1024,
+		PingInterval:     time.Second * 54,
+		PongTimeout:      time.Second * 60,
+		WriteTimeout:     time.Second * 10,
+		SendQueueSize:    256,
+		Overflow:         OverflowDisconnect,
+		Compression:      true,
+		CompressionLevel: flate.BestSpeed,
+		ResumeBuffer:     256,
+		ResumeTimeout:    time.Minute * 2,
+		PresenceTTL:      time.Second * 30,
+		AwayAfter:        time.Minute * 5,
+	}
+}
 
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
-
-	// channel reading error
-	errChannelReading = errors.New("channel reading error")
-	// writer beign error
-	errWriterBegin = errors.New("write begin error")
-	// writing error
-	errWriting = errors.New("writing error")
-
-	// websocket upgrader
-	ug = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+func (cfg *WSConfig) validate() error {
+	if cfg.ReadLimit <= 0 {
+		return errors.New("websocket read limit must be positive")
 	}
-)
+	if cfg.ReadBufferSize < 0 || cfg.WriteBufferSize < 0 {
+		return errors.New("websocket buffer sizes can't be negative")
+	}
+	if cfg.PingInterval <= 0 || cfg.PingInterval >= cfg.PongTimeout {
+		return errors.New("websocket ping interval must be positive, and less than the pong timeout")
+	}
+	if cfg.WriteTimeout <= 0 {
+		return errors.New("websocket write timeout must be positive")
+	}
+	if cfg.SendQueueSize <= 0 {
+		return errors.New("websocket send queue size must be positive")
+	}
+	if cfg.Overflow != OverflowDropOldest && cfg.Overflow != OverflowDisconnect {
+		return fmt.Errorf("unknown websocket overflow policy: %s", cfg.Overflow)
+	}
+	if cfg.CompressionLevel < flate.HuffmanOnly || cfg.CompressionLevel > flate.BestCompression {
+		return errors.New("websocket compression level must be from -2 to 9")
+	}
+	if cfg.ResumeBuffer <= 0 || cfg.ResumeTimeout <= 0 {
+		return errors.New("websocket resume buffer and timeout must be positive")
+	}
+	if cfg.PresenceTTL <= 0 || cfg.AwayAfter <= 0 {
+		return errors.New("websocket presence ttl and away timeout must be positive")
+	}
+	return nil
+}
 
 type client struct {
+	hub *hub
 	// The websocket connection.
 	ws *websocket.Conn
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// the outbound frames, owned by the client, taken by the writePump
+	queue *sendQueue
+	// the codec negotiated at upgrade
+	codec codec
+	// the session of the connection, set before the pumps start
+	session *session
+
+	// closed to ask the writePump to flush and send the close frame.
+	quit      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+	// closed when the connection is gone.
+	done chan struct{}
+
+	id string
+	// logger with the connection id
+	log *logrus.Entry
+	// the span of the upgrade request, linked from the spans of the messages
+	span trace.SpanContext
+
+	username string
+	// the id of the token, and the timer closing the connection when it expires
+	mu      sync.Mutex
+	tokenID string
+	expiry  *time.Timer
+	// when the last message came, and whether the client set itself away
+	lastActive time.Time
+	away       bool
+	// the users whose presence is pushed to the client
+	watching map[string]struct{}
+	// the chat channels joined, and the lists of the user, loaded at the first join
+	channels  map[string]struct{}
+	chatLists *core.ChatLists
+}
+
+func newClient(h *hub, ws *websocket.Conn, log *logrus.Entry, span trace.SpanContext, claims *jwt.StandardClaims) *client {
+	id := newID()
+	c := &client{
+		hub:      h,
+		ws:       ws,
+		codec:    codecOf(ws.Subprotocol()),
+		id:       id,
+		log:      log.WithFields(logrus.Fields{"conn_id": id, "username": claims.Subject}),
+		span:     span,
+		username: claims.Subject,
+		queue:    newSendQueue(h.cfg.SendQueueSize, h.cfg.Overflow),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+
+		lastActive: time.Now(),
+	}
+	c.authorize(claims)
+	return c
 }
 
-func getWSHandler(db *mongo.Database) gin.HandlerFunc {
+// authorize the connection with the token of the claims, until it expires
+func (c *client) authorize(claims *jwt.StandardClaims) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tokenID = claims.Id
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	c.expiry = time.AfterFunc(time.Until(time.Unix(claims.ExpiresAt, 0)), func() {
+		c.close(closeTokenExpired, "token expired")
+	})
+}
+
+// the id of the token the connection is authorized with
+func (c *client) token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tokenID
+}
+
+// active unless it's set away, or idle for the timeout
+func (c *client) active(timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.away && time.Since(c.lastActive) < timeout
+}
+
+// touch the client when a message comes, reports whether it was idle
+func (c *client) touch(timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idle := time.Since(c.lastActive) >= timeout
+	c.lastActive = time.Now()
+	return idle
+}
+
+// whether the presence of the user is pushed to the client
+func (c *client) watches(username string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.watching[username]
+	return ok
+}
+
+// close the client gracefully, the pending messages are sent before the close frame
+func (c *client) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.quit)
+	})
+}
+
+// enqueue the outbound frame without blocking, the pending one of the same key is replaced,
+// a full queue is handled by the overflow policy
+func (c *client) enqueue(key string, frame []byte) bool {
+	switch c.queue.push(outbound{key: key, frame: frame}) {
+	case pushCoalesced:
+		c.hub.metrics.wsCoalesced.Inc()
+	case pushDroppedOldest:
+		c.hub.metrics.wsDrops.WithLabelValues(string(OverflowDropOldest)).Inc()
+	case pushOverflow:
+		// too slow to catch up, the pending frames are dropped with the connection
+		dropped := len(c.queue.take()) + 1
+		c.hub.metrics.wsDrops.WithLabelValues(string(OverflowDisconnect)).Add(float64(dropped))
+		c.log.WithField("dropped", dropped).Warn("websocket send queue overflow")
+		c.close(closeSlowConsumer, "too slow")
+		return false
+	case pushClosed:
+		c.hub.metrics.wsDrops.WithLabelValues("closed").Inc()
+		return false
+	}
+	return true
+}
+
+// the error message of the peer
+type wsError struct {
+	// the type of the message which failed
+	For    string `json:"for,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// getWSHandler upgrades the authorized connections, the credentials come with a ticket in the query,
+// or the token in the subprotocols, or the first message after the upgrade,
+// the token never goes in the url
+func getWSHandler(h *hub, tokens *tokens, t *tickets, o *origins) gin.HandlerFunc {
+	up := websocket.Upgrader{
+		ReadBufferSize:    h.cfg.ReadBufferSize,
+		WriteBufferSize:   h.cfg.WriteBufferSize,
+		EnableCompression: h.cfg.Compression,
+		CheckOrigin:       o.checkOrigin,
+		Subprotocols:      codecProtocols(),
+	}
+
 	return func(c *gin.Context) {
-		tokenStr := c.DefaultQuery("token", "")
+		// before the credentials, a ticket from a forbidden origin must not be spent
+		if !o.checkOrigin(c.Request) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"reason": "origin not allowed",
+			})
+			return
+		}
 
-		if len(tokenStr) == 0 {
+		claims, err := wsCredentials(c.Request, tokens, t)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"reason": "authorization field empty",
+				"reason": err.Error(),
 			})
 			return
 		}
-		// log.Println("token", tokenStr)
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-			// Don't forget to validate the alg is what you expect:
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return jwtKey, nil
-		})
 
+		ws, err := up.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
-			if err.Error() == "Token is expired" {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"reason": "token is expired",
-				})
-			} else {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"reason": "token is invalid",
-				})
-			}
+			// the upgrader has replied already
+			requestLog(c).WithError(err).Warn("websocket upgrade failed")
 			return
 		}
+		if h.cfg.Compression {
+			// only if the peer accepted it
+			ws.EnableWriteCompression(true)
+			ws.SetCompressionLevel(h.cfg.CompressionLevel)
+		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			log.Println(claims["jti"], claims["exp"])
-			c.Set("username", claims["jti"])
-			c.Next()
-		} else {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"reason": "token is invalid",
-			})
-			return
+		if claims == nil {
+			if claims, err = wsAuthenticate(ws, codecOf(ws.Subprotocol()), tokens, h.cfg.ReadLimit); err != nil {
+				requestLog(c).WithError(err).Info("websocket auth failed")
+				code := closeAuthFailed
+				if err == errMessageTooBig {
+					code = websocket.CloseMessageTooBig
+				}
+				ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(code, err.Error()), time.Now().Add(h.cfg.WriteTimeout))
+				ws.Close()
+				return
+			}
 		}
 
-		ws, err := ug.Upgrade(c.Writer, c.Request, nil)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"reason": "websocket upgrade failed"})
+		wsc := newClient(h, ws, requestLog(c), trace.SpanContextFromContext(c.Request.Context()), claims)
+		if err := h.register(wsc); err != nil {
+			wsc.expiry.Stop()
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"), time.Now().Add(h.cfg.WriteTimeout))
+			ws.Close()
 			return
 		}
 
-		wsc := &client{ws: ws, send: make(chan []byte, 256)}
-		defer close(wsc.send)
+		q := c.Request.URL.Query()
+		resumed, err := h.resume(wsc, parseResume(q.Get("session"), q.Get("seq")))
+		if err != nil {
+			wsc.log.WithError(err).Warn("websocket session failed")
+		}
 
+		wsc.log.WithFields(logrus.Fields{"session": wsc.session.id, "resumed": resumed}).Info("websocket connected")
+		h.connected(wsc)
 		go wsc.writePump()
-		go wsc.readPump(db)
+		go wsc.readPump()
 	}
 }
 
-func (c *client) readPump(db *mongo.Database) {
+func (c *client) readPump() {
 	defer func() {
-		// c.hub.unregister <- c
+		c.hub.unregister(c)
+		c.hub.detach(c)
+		c.queue.close()
 		c.ws.Close()
+		c.mu.Lock()
+		c.expiry.Stop()
+		c.mu.Unlock()
+		close(c.done)
+		c.log.Info("websocket disconnected")
 	}()
-	c.ws.SetReadLimit(maxMessageSize)
-	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	pongTimeout := c.hub.cfg.PongTimeout
+	c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
 	c.ws.SetPongHandler(func(string) error {
-		c.ws.SetReadDeadline(time.Now().Add(pongWait))
+		c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
 		return nil
 	})
 
 	for {
-		_, msg, err := c.ws.ReadMessage()
+		frame, err := readFrame(c.ws, c.hub.cfg.ReadLimit)
+		if err == errMessageTooBig {
+			c.log.Info("websocket message too big")
+			c.close(websocket.CloseMessageTooBig, err.Error())
+			continue
+		}
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
+				c.log.WithError(err).Warn("websocket closed unexpectedly")
 			}
 			break
 		}
 
-		msg = bytes.TrimSpace(bytes.Replace(msg, newline, space, -1))
-		if len(msg) > 0 {
-			log.Println("websocket <", string(msg))
+		// closing, wait for the close frame of the peer
+		select {
+		case <-c.quit:
+			continue
+		default:
+		}
+
+		// back from idle
+		if c.touch(c.hub.cfg.AwayAfter) {
+			c.hub.refresh(c.username)
+		}
+
+		m, err := c.codec.decode(frame)
+		if err != nil {
+			c.hub.metrics.wsMessages.WithLabelValues("in", "malformed").Inc()
+			c.push("error", &wsError{Reason: err.Error()})
+			continue
+		}
+
+		// the game actions are not done, when the hub is shutting down
+		if err := c.hub.beginAction(); err != nil {
+			continue
+		}
+		c.dispatch(m, len(frame))
+		c.hub.endAction()
+	}
+}
+
+// readFrame reads the next message, the limit applies after the decompression too
+func readFrame(ws *websocket.Conn, limit int64) ([]byte, error) {
+	_, r, err := ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	frame, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(frame)) > limit {
+		return nil, errMessageTooBig
+	}
+	return frame, nil
+}
+
+// dispatch the message of the peer to the handler of its type, in a span of its own linked to the connection,
+// the error of the handler is sent back
+func (c *client) dispatch(m *message, size int) {
+	ctx, span := c.hub.tracer.Start(context.Background(), "ws.dispatch",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithLinks(trace.Link{SpanContext: c.span}),
+		trace.WithAttributes(
+			connIDKey.String(c.id),
+			attribute.String("ws.message.type", m.Type),
+			attribute.Int("ws.message.size", size),
+		))
+	defer span.End()
+
+	h, ok := c.hub.handler(m.Type)
+	if !ok {
+		c.hub.metrics.wsMessages.WithLabelValues("in", "unknown").Inc()
+		c.push("error", &wsError{For: m.Type, Reason: errUnknownMessage.Error()})
+		return
+	}
+	c.hub.metrics.wsMessages.WithLabelValues("in", m.Type).Inc()
+
+	c.log.WithFields(logrus.Fields{
+		"type":     m.Type,
+		"size":     size,
+		"trace_id": span.SpanContext().TraceID().String(),
+	}).Debug("websocket message received")
+
+	if err := h(ctx, c, m); err != nil {
+		endSpan(span, err)
+		c.push("error", &wsError{For: m.Type, Reason: err.Error()})
+	}
+}
+
+// push the message of the type to the peer, encoded by the codec of the connection
+func (c *client) push(typ string, data interface{}) error {
+	return c.pushKeyed("", typ, data)
+}
+
+// pushKeyed replaces the pending message of the same key, only the latest one is sent,
+// for the states which are stale once changed again, the seq of the replaced one is skipped
+func (c *client) pushKeyed(key, typ string, data interface{}) error {
+	return c.session.send(key, typ, data)
+}
+
+// pushUnsequenced sends the message without a seq, it's not replayed
+func (c *client) pushUnsequenced(typ string, data interface{}) error {
+	frame, err := c.codec.encode(0, typ, data)
+	if err != nil {
+		return err
+	}
+	if !c.enqueue("", frame) {
+		return errSendQueueFull
+	}
+	c.hub.metrics.wsMessages.WithLabelValues("out", typ).Inc()
+	return nil
+}
+
+// write the frames, one frame per message
+func (c *client) write(items []outbound) error {
+	for _, o := range items {
+		c.ws.SetWriteDeadline(time.Now().Add(c.hub.cfg.WriteTimeout))
+		if err := c.ws.WriteMessage(c.codec.frameType(), o.frame); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func (c *client) writePump() {
 	// ping ticker
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.hub.cfg.PingInterval)
 	defer func() {
 		ticker.Stop()
 		c.ws.Close()
@@ -151,35 +494,38 @@ func (c *client) writePump() {
 
 	for {
 		select {
-		// receive the sending channel message
-		case msg, ok := <-c.send:
-			if !ok {
-				log.Println("send channel closed")
-				c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+		// the connection is gone
+		case <-c.done:
+			return
+		// flush the pending messages, then say goodbye
+		case <-c.quit:
+			c.queue.close()
+			if err := c.write(c.queue.take()); err != nil {
+				c.log.WithError(err).Warn("failed to flush")
 				return
 			}
-			w, err := c.ws.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Println("failed to create writer")
+			c.ws.SetWriteDeadline(time.Now().Add(c.hub.cfg.WriteTimeout))
+			if err := c.ws.WriteMessage(websocket.CloseMessage, c.closeMsg); err != nil {
+				c.log.WithError(err).Warn("failed to write close")
 				return
 			}
-			w.Write(msg)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
+			// let the readPump wait for the close frame of the peer, then close the connection,
+			// or close it anyway after the grace period, which ends the readPump too
+			select {
+			case <-c.done:
+			case <-time.After(closeGracePeriod):
 			}
-
-			if err := w.Close(); err != nil {
-				log.Println("failed to close writer")
+			return
+		// the pending messages
+		case <-c.queue.ready:
+			if err := c.write(c.queue.take()); err != nil {
+				c.log.WithError(err).Warn("failed to write")
 				return
 			}
 		case <-ticker.C:
-			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			c.ws.SetWriteDeadline(time.Now().Add(c.hub.cfg.WriteTimeout))
 			if err := c.ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				log.Println("failed to write ping")
+				c.log.WithError(err).Debug("failed to write ping")
 				return
 			}
 		}
@@ -0,0 +1,172 @@
+package vanilla
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// the subprotocol of the game, the browsers need the server to select one
+	wsProtocol = "vanilla"
+	// the subprotocol carrying the token, like bearer.<token>
+	wsBearerPrefix = "bearer."
+
+	// lifetime of the websocket tickets
+	wsTicketTTL = time.Second * 30
+	// time allowed for the auth message, when no credentials come with the upgrade
+	wsAuthTimeout = time.Second * 5
+
+	// the close codes of the game
+	closeAuthFailed   = 4001
+	closeTokenExpired = 4002
+	closeTokenRevoked = 4003
+	closeSlowConsumer = 4004
+)
+
+var (
+	// the ticket is unknown, used or expired
+	errTicketInvalid = errors.New("ticket is invalid")
+	// the first message is not an auth message
+	errAuthMessage = errors.New("auth message expected")
+)
+
+// the data of the auth message, which authorizes the connection, the first message if no credentials come with the upgrade,
+// or a later one to renew the token before it expires
+type authData struct {
+	Token string `json:"token"`
+}
+
+// tickets are the one-time credentials of the websocket upgrade,
+// so the browsers don't put the token in the url
+type tickets struct {
+	mu      sync.Mutex
+	tickets map[string]ticket
+}
+
+// a ticket of the token claims
+type ticket struct {
+	claims  *jwt.StandardClaims
+	expires time.Time
+}
+
+func newTickets() *tickets {
+	return &tickets{tickets: make(map[string]ticket)}
+}
+
+// issue a ticket of the claims, it expires after the wsTicketTTL
+func (t *tickets) issue(claims *jwt.StandardClaims) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// forget the expired ones
+	now := time.Now()
+	for id, tk := range t.tickets {
+		if now.After(tk.expires) {
+			delete(t.tickets, id)
+		}
+	}
+
+	id := newID() + newID()
+	t.tickets[id] = ticket{claims: claims, expires: now.Add(wsTicketTTL)}
+	return id
+}
+
+// redeem the ticket, it's gone afterwards
+func (t *tickets) redeem(id string) (*jwt.StandardClaims, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tk, ok := t.tickets[id]
+	delete(t.tickets, id)
+	if !ok || time.Now().After(tk.expires) {
+		return nil, errTicketInvalid
+	}
+	return tk.claims, nil
+}
+
+// issue a websocket ticket to the caller
+func getTicketHandler(t *tickets) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*jwt.StandardClaims)
+		c.JSON(http.StatusOK, gin.H{
+			"ticket":  t.issue(claims),
+			"expires": int(wsTicketTTL / time.Second),
+		})
+	}
+}
+
+// the credentials of the upgrade request: the ticket in the query, or the token in the subprotocols,
+// nil if neither, then the first message must be an auth message
+func wsCredentials(r *http.Request, tokens *tokens, t *tickets) (*jwt.StandardClaims, error) {
+	if id := r.URL.Query().Get("ticket"); len(id) > 0 {
+		claims, err := t.redeem(id)
+		if err != nil {
+			return nil, err
+		}
+		// the token may be revoked after the ticket is issued
+		if tokens.isRevoked(claims.Id) {
+			return nil, errTokenRevoked
+		}
+		if time.Now().Unix() > claims.ExpiresAt {
+			return nil, errTokenExpired
+		}
+		return claims, nil
+	}
+
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, wsBearerPrefix) {
+			return tokens.parse(strings.TrimPrefix(p, wsBearerPrefix))
+		}
+	}
+	return nil, nil
+}
+
+// wsAuthenticate reads the auth message, which must come first and in time
+func wsAuthenticate(ws *websocket.Conn, cd codec, tokens *tokens, limit int64) (*jwt.StandardClaims, error) {
+	ws.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+
+	frame, err := readFrame(ws, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := cd.decode(frame)
+	if err != nil || m.Type != "auth" {
+		return nil, errAuthMessage
+	}
+	var data authData
+	if err := cd.unmarshal(m.Data, &data); err != nil {
+		return nil, errAuthMessage
+	}
+	return tokens.parse(data.Token)
+}
+
+// handleAuth renews the token of the connection, it must be of the same user,
+// the connection is closed if the token is no good
+func handleAuth(ctx context.Context, c *client, m *message) error {
+	var data authData
+	if err := c.codec.unmarshal(m.Data, &data); err != nil {
+		return errAuthMessage
+	}
+
+	claims, err := c.hub.tokens.parse(data.Token)
+	if err == nil && claims.Subject != c.username {
+		err = errTokenInvalid
+	}
+	if err != nil {
+		c.log.WithError(err).Info("websocket auth failed")
+		c.close(closeAuthFailed, err.Error())
+		return nil
+	}
+	c.authorize(claims)
+	return nil
+}
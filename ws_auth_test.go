@@ -0,0 +1,117 @@
+package vanilla
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// the auth message in json
+func authFrame(token string) interface{} {
+	return gin.H{"type": "auth", "data": authData{Token: token}}
+}
+
+func TestWSAuth(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws://" + s.Addr() + "/ws"
+
+	// the token in the query is not a credential anymore, the first message must be
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("Hello"))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeAuthFailed))
+	conn.Close()
+
+	// one-time ticket
+	req, _ := http.NewRequest("POST", "/api/ws/ticket", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct{ Ticket string }
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	// a forbidden origin doesn't spend it
+	_, r, err := websocket.DefaultDialer.Dial(url+"?ticket="+resp.Ticket, http.Header{"Origin": {"https://evil.com"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, r.StatusCode)
+
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?ticket="+resp.Ticket, nil)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	_, r, err = websocket.DefaultDialer.Dial(url+"?ticket="+resp.Ticket, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+
+	// the first message
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteJSON(authFrame("bogus"))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeAuthFailed))
+	conn.Close()
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteJSON(authFrame(token))
+	readConnected(t, conn, jsonCodec{})
+
+	// closed when the token is revoked
+	req, _ = http.NewRequest("POST", "/api/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	time.Sleep(time.Millisecond * 50)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeTokenRevoked))
+	conn.Close()
+
+	_, _, err = dialWS(websocket.DefaultDialer, url, token, nil)
+	assert.Error(t, err)
+}
+
+func TestWSTokenExpiry(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.Shutdown(context.Background())
+
+	short, _ := s.tokens.issue("aspirin2d", time.Second)
+	conn, resp, err := dialWS(websocket.DefaultDialer, "ws://"+s.Addr()+"/ws", short, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, wsProtocol, resp.Header.Get("Sec-WebSocket-Protocol"))
+	readConnected(t, conn, jsonCodec{})
+
+	// renewed in time
+	renewed, _ := s.tokens.issue("aspirin2d", time.Second*3)
+	conn.WriteJSON(authFrame(renewed))
+
+	start := time.Now()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeTokenExpired))
+	assert.True(t, time.Since(start) > time.Second*3/2)
+	conn.Close()
+}
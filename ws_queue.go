@@ -0,0 +1,118 @@
+package vanilla
+
+import (
+	"sync"
+)
+
+// OverflowPolicy of a full send queue, the pending frame of the same key is replaced
+// before any policy applies: it's stale anyway, and the replacement never grows the queue,
+// so neither dropping a message nor disconnecting is needed for it
+type OverflowPolicy string
+
+const (
+	// drop the oldest message to make room, the peer may resync later
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// close the connection with closeSlowConsumer, nothing is lost silently
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// the result of a push to the send queue
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	// replaced the pending message of the same key
+	pushCoalesced
+	// queued, after dropping the oldest one
+	pushDroppedOldest
+	// full, the connection should be closed
+	pushOverflow
+	// the queue is closed, the message is dropped
+	pushClosed
+)
+
+// an outbound frame, the frames of the same non-empty key replace each other while pending
+type outbound struct {
+	key   string
+	frame []byte
+}
+
+// sendQueue of a connection, the producers never block and never panic on a closed connection,
+// only the writePump takes from it
+type sendQueue struct {
+	mu     sync.Mutex
+	items  []outbound
+	size   int
+	policy OverflowPolicy
+	closed bool
+
+	// signaled when there is something to take, never closed
+	ready chan struct{}
+}
+
+func newSendQueue(size int, policy OverflowPolicy) *sendQueue {
+	return &sendQueue{size: size, policy: policy, ready: make(chan struct{}, 1)}
+}
+
+// push the frame without blocking
+func (q *sendQueue) push(o outbound) pushResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return pushClosed
+	}
+
+	result := pushQueued
+	if len(o.key) > 0 {
+		for i := range q.items {
+			if q.items[i].key == o.key {
+				// the latest state wins, at the tail, so the frames stay in the order of their seq
+				q.items = append(q.items[:i], q.items[i+1:]...)
+				q.items = append(q.items, o)
+				return pushCoalesced
+			}
+		}
+	}
+
+	if len(q.items) >= q.size {
+		if q.policy != OverflowDropOldest {
+			return pushOverflow
+		}
+		q.items = q.items[1:]
+		result = pushDroppedOldest
+	}
+
+	q.items = append(q.items, o)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// take all the pending frames
+func (q *sendQueue) take() []outbound {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// close the queue, the pending frames are still there to take
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+}
+
+// the number of the pending frames
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
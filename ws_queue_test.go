@@ -0,0 +1,98 @@
+package vanilla
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue(2, OverflowDropOldest)
+	assert.Equal(t, pushQueued, q.push(outbound{key: "state", frame: []byte("1")}))
+	assert.Equal(t, pushQueued, q.push(outbound{frame: []byte("a")}))
+	// the pending state is replaced, at the tail
+	assert.Equal(t, pushCoalesced, q.push(outbound{key: "state", frame: []byte("2")}))
+	assert.Equal(t, 2, q.len())
+	// full, the oldest goes
+	assert.Equal(t, pushDroppedOldest, q.push(outbound{frame: []byte("b")}))
+
+	<-q.ready
+	items := q.take()
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, "2", string(items[0].frame))
+		assert.Equal(t, "b", string(items[1].frame))
+	}
+
+	q = newSendQueue(1, OverflowDisconnect)
+	q.push(outbound{frame: []byte("a")})
+	assert.Equal(t, pushOverflow, q.push(outbound{frame: []byte("b")}))
+	q.close()
+	assert.Equal(t, pushClosed, q.push(outbound{frame: []byte("c")}))
+	// still there to flush
+	assert.Len(t, q.take(), 1)
+}
+
+// a client of the hub without a connection, its frames stay in the queue
+func newTestClient(h *hub) *client {
+	c := &client{
+		hub:     h,
+		codec:   jsonCodec{},
+		session: &session{hub: h},
+		queue:   newSendQueue(h.cfg.SendQueueSize, h.cfg.Overflow),
+		quit:    make(chan struct{}),
+		log:     logrus.NewEntry(logrus.StandardLogger()),
+	}
+	c.session.client = c
+	return c
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	cfg := DefaultWSConfig()
+	cfg.SendQueueSize = 1
+	h := newHub(cfg, newMetrics(), trace.NewNoopTracerProvider().Tracer(""), nil, newMemoryBroker())
+	c := newTestClient(h)
+
+	assert.NoError(t, c.push("a", nil))
+	assert.Equal(t, errSendQueueFull, c.push("b", nil))
+
+	// disconnected, nothing pending
+	select {
+	case <-c.quit:
+	default:
+		t.Fatal("client is not closed")
+	}
+	assert.Equal(t, 0, c.queue.len())
+	assert.Contains(t, string(c.closeMsg), "too slow")
+}
+
+func TestSendQueueCoalesce(t *testing.T) {
+	// the same under every policy, even when the queue is full
+	for _, policy := range []OverflowPolicy{OverflowDropOldest, OverflowDisconnect} {
+		cfg := DefaultWSConfig()
+		cfg.SendQueueSize = 2
+		cfg.Overflow = policy
+		h := newHub(cfg, newMetrics(), trace.NewNoopTracerProvider().Tracer(""), nil, newMemoryBroker())
+		c := newTestClient(h)
+
+		// the replaced state goes after the note, never a lower seq after a higher one
+		assert.NoError(t, c.pushKeyed("state", "state", 1), policy)
+		assert.NoError(t, c.push("note", nil), policy)
+		assert.NoError(t, c.pushKeyed("state", "state", 2), policy)
+
+		select {
+		case <-c.quit:
+			t.Fatal("client is closed", policy)
+		default:
+		}
+		var seqs []uint64
+		for _, o := range c.queue.take() {
+			var env envelope
+			json.Unmarshal(o.frame, &env)
+			seqs = append(seqs, env.Seq)
+		}
+		assert.Equal(t, []uint64{2, 3}, seqs, policy)
+	}
+}
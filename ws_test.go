@@ -0,0 +1,59 @@
+package vanilla
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWSLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WS.ReadLimit = 256
+	cfg.WS.PingInterval = time.Millisecond * 100
+	cfg.WS.PongTimeout = time.Millisecond * 300
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+
+	token, err := getToken(s.router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws://" + s.Addr() + "/ws"
+
+	// compressed if the client offers it
+	d := *websocket.DefaultDialer
+	d.EnableCompression = true
+	conn, resp, err := dialWS(&d, url, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	readConnected(t, conn, jsonCodec{})
+
+	// the pings keep the connection alive, while the client is reading
+	frame, _ := jsonCodec{}.encode(0, "nonsense", nil)
+	written := make(chan struct{})
+	go func() {
+		time.Sleep(time.Millisecond * 500)
+		conn.WriteMessage(websocket.TextMessage, frame)
+		close(written)
+	}()
+	_, msg, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Contains(t, string(msg), errUnknownMessage.Error())
+	<-written
+
+	// too big, even if it's small on the wire
+	conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 512)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+	conn.Close()
+
+	cfg.WS.PingInterval = cfg.WS.PongTimeout
+	_, err = New(cfg)
+	assert.Error(t, err)
+}